@@ -0,0 +1,93 @@
+package main
+
+import (
+	ind "github.com/trustnetworks/indicators"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// summary of a dynamic IOC loaded into the detector
+type IOCSummary struct {
+	ID       string `json:"id"`
+	AlertKey string `json:"alert_key"`
+	Type     string `json:"type"`
+	Value    string `json:"value"`
+	Category string `json:"category"`
+	Timeout  int64  `json:"timeout"`
+}
+
+// an IOC tree along with the alert it was created from
+type IOCDetail struct {
+	Alert AlertData          `json:"alert"`
+	IOC   *ind.IndicatorNode `json:"ioc"`
+}
+
+// lists all the dynamic IOC roots loaded, ordered by expiry
+func (as *alertServer) handleIOCs(w http.ResponseWriter, r *http.Request) {
+	iocs := make([]IOCSummary, 0)
+	as.dd.lock.RLock()
+	for key, a := range as.dd.index.alerts {
+		ioc := as.dd.alertToIOCMap[a]
+		if ioc == nil {
+			continue
+		}
+		iocs = append(iocs, IOCSummary{
+			ID:       ioc.ID,
+			AlertKey: key,
+			Type:     a.Type,
+			Value:    a.Indicator.Value,
+			Category: a.Indicator.Category,
+			Timeout:  as.dd.alerts[a],
+		})
+	}
+	as.dd.lock.RUnlock()
+
+	sort.Slice(iocs, func(i, j int) bool {
+		if iocs[i].Timeout != iocs[j].Timeout {
+			return iocs[i].Timeout < iocs[j].Timeout
+		}
+		return iocs[i].ID < iocs[j].ID
+	})
+	writeJSON(w, iocs)
+}
+
+// finds an IOC by its root ID or by the key of the alert it was created from
+func (as *alertServer) findIOC(id string) (IOCDetail, bool) {
+	as.dd.lock.RLock()
+	defer as.dd.lock.RUnlock()
+	a, ok := as.dd.iocAlerts[id]
+	key := id
+	if ok {
+		key = a.Key()
+	} else {
+		a, ok = as.dd.index.get(id)
+	}
+	ioc := as.dd.alertToIOCMap[a]
+	if ok && ioc != nil {
+		return IOCDetail{
+			Alert: AlertData{Key: key, Alert: a, Timeout: as.dd.alerts[a], ValidFrom: as.dd.validFrom[a]},
+			IOC:   ioc,
+		}, true
+	}
+	return IOCDetail{}, false
+}
+
+// returns the IOC tree for an IOC ID or alert key, /admin/iocs/<id>. The
+// tree is returned as JSON, or as indented text with ?format=text
+func (as *alertServer) handleIOC(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/admin/iocs/")
+	detail, ok := as.findIOC(id)
+	if !ok {
+		http.Error(w, "IOC not found", http.StatusNotFound)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("IOC " + detail.IOC.ID + " for alert " + detail.Alert.Key + "\n" +
+			printNode(detail.IOC, "")))
+		return
+	}
+	writeJSON(w, detail)
+}
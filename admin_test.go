@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminListsIOCs(t *testing.T) {
+	as, vpnAlert, officeAlert := testAlertServer(t)
+
+	rec := httptest.NewRecorder()
+	as.handleIOCs(rec, httptest.NewRequest("GET", "/admin/iocs", nil))
+
+	var iocs []IOCSummary
+	err := json.Unmarshal(rec.Body.Bytes(), &iocs)
+	if err != nil {
+		t.Fatal("JSON unmarshal error: ", err.Error())
+	}
+	if len(iocs) != 2 {
+		t.Fatal("expected an IOC for each alert, got ", len(iocs))
+	}
+	if iocs[0].AlertKey != vpnAlert.Key() || iocs[1].AlertKey != officeAlert.Key() {
+		t.Error("IOCs should be listed soonest expiring first")
+	}
+	if iocs[0].ID != as.dd.alertToIOCMap[vpnAlert].ID || iocs[0].Timeout != as.dd.alerts[vpnAlert] {
+		t.Error("IOC summary should have the root ID and expiry of the IOC")
+	}
+	as.dd.cleanup()
+}
+
+func TestAdminReturnsIOCTree(t *testing.T) {
+	as, vpnAlert, _ := testAlertServer(t)
+	ioc := as.dd.alertToIOCMap[vpnAlert]
+
+	// look up by IOC ID
+	rec := httptest.NewRecorder()
+	as.handleIOC(rec, httptest.NewRequest("GET", "/admin/iocs/"+ioc.ID, nil))
+	var detail IOCDetail
+	err := json.Unmarshal(rec.Body.Bytes(), &detail)
+	if err != nil {
+		t.Fatal("JSON unmarshal error: ", err.Error())
+	}
+	if detail.IOC == nil || detail.IOC.ID != ioc.ID || len(detail.IOC.Children) != len(ioc.Children) {
+		t.Error("IOC tree returned does not match the IOC loaded")
+	}
+	if detail.Alert.Alert != vpnAlert {
+		t.Error("IOC should be returned with the alert it was created from")
+	}
+
+	// look up by alert key as text
+	rec = httptest.NewRecorder()
+	as.handleIOC(rec, httptest.NewRequest("GET", "/admin/iocs/"+vpnAlert.Key()+"?format=text", nil))
+	if !strings.Contains(rec.Body.String(), printNode(ioc, "")) {
+		t.Error("text format should contain the printed IOC tree, got ", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	as.handleIOC(rec, httptest.NewRequest("GET", "/admin/iocs/unknown", nil))
+	if rec.Code != 404 {
+		t.Error("unknown IOC should return not found")
+	}
+	as.dd.cleanup()
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	dt "github.com/trustnetworks/analytics-common/datatypes"
 )
 
@@ -16,14 +19,35 @@ type Alert struct {
 	Src       CommsInfo    `json:"src"`
 	Dest      CommsInfo    `json:"dest"`
 	Device    string       `json:"device"`
+	Network   string       `json:"network,omitempty"`
 	Indicator dt.Indicator `json:"indicator"`
 }
 
+// returns a stable identifier for the alert, the same alert has the same key
+// on every dynamic detector
+func (a Alert) Key() string {
+	js, _ := json.Marshal(a)
+	sum := sha256.Sum256(js)
+	return hex.EncodeToString(sum[:16])
+}
+
 type AlertData struct {
-	Alert   Alert `json:"alert"`
-	Timeout int64 `json:"timeout"`
+	Key     string `json:"key,omitempty"`
+	Alert   Alert  `json:"alert"`
+	Timeout int64  `json:"timeout"`
+	// time the alert became active, zero if not known
+	ValidFrom int64 `json:"valid_from,omitempty"`
 }
 
 type AlertsMessage struct {
 	Alerts []AlertData `json:"alerts"`
+	// sender's clock (unix seconds) when the message was created, lets the
+	// receiver correct the alert timeouts for clock skew between pods
+	Now int64 `json:"now,omitempty"`
+	// cursor for the next page of a paginated query, empty on the last page
+	Next string `json:"next,omitempty"`
+	// our clock (unix seconds) when the response headers arrived, so skew is
+	// measured without the time taken to read the body. Set by the receiver,
+	// zero means now
+	Received int64 `json:"-"`
 }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	jsonContentType = "application/json; charset=utf-8"
+	// compact binary encoding of alert state, understood by other dynamic
+	// detectors
+	gobContentType = "application/x-gob"
+)
+
+// returns true if the header lists the value, ignoring any parameters.
+// Values with q=0 are treated as not listed
+func headerAccepts(header, value string) bool {
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		if strings.TrimSpace(fields[0]) != value {
+			continue
+		}
+		for _, param := range fields[1:] {
+			if strings.Replace(strings.TrimSpace(param), " ", "", -1) == "q=0" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// writes alert state using the encoding and compression the client asked for,
+// encoding straight to the response rather than building it in memory
+func writeAlerts(w http.ResponseWriter, r *http.Request, am AlertsMessage) error {
+	contentType := jsonContentType
+	if headerAccepts(r.Header.Get("Accept"), gobContentType) {
+		contentType = gobContentType
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Add("Vary", "Accept, Accept-Encoding")
+
+	var out io.Writer = w
+	if headerAccepts(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
+
+	if contentType == gobContentType {
+		return gob.NewEncoder(out).Encode(am)
+	}
+	return json.NewEncoder(out).Encode(am)
+}
+
+// asks for the compact encoding and compression when requesting alert state
+func setAlertsRequestHeaders(req *http.Request) {
+	req.Header.Set("Accept", gobContentType+", application/json;q=0.9")
+	req.Header.Set("Accept-Encoding", "gzip")
+}
+
+// decodes alert state from a response in whichever encoding was sent,
+// streaming from the body rather than reading it all first
+func decodeAlerts(resp *http.Response, am *AlertsMessage) error {
+	var body io.Reader = resp.Body
+	switch resp.Header.Get("Content-Encoding") {
+	case "":
+	case "gzip":
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		body = gz
+	default:
+		return errors.New("unsupported content encoding " + resp.Header.Get("Content-Encoding"))
+	}
+
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), gobContentType) {
+		return gob.NewDecoder(body).Decode(am)
+	}
+	return json.NewDecoder(body).Decode(am)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"container/heap"
+	log "github.com/sirupsen/logrus"
+	"github.com/trustnetworks/analytics-common/utils"
+	"github.com/trustnetworks/analytics-common/worker"
+	"strconv"
+	"strings"
+)
+
+const (
+	// evict the alert that will expire soonest
+	evictSoonestExpiring = "soonest-expiring"
+	// evict the alert with the lowest indicator probability
+	evictLowestProbability = "lowest-probability"
+	// keep the current alerts and drop the new one
+	evictRejectNew = "reject-new"
+)
+
+// capacity limits on the alert store, a value of 0 means no limit
+type alertLimits struct {
+	maxAlerts  int
+	maxPerType map[string]int
+	eviction   string
+}
+
+func (l *alertLimits) init() {
+	l.maxAlerts = 0
+	maxAlerts := utils.Getenv("ALERT_STORE_MAX_ALERTS", "0")
+	if n, err := strconv.Atoi(maxAlerts); err == nil && n > 0 {
+		l.maxAlerts = n
+	} else if err != nil {
+		log.Error("Invalid ALERT_STORE_MAX_ALERTS '", maxAlerts, "', alert store will be unlimited")
+	}
+
+	// format is alert type=limit, comma separated e.g. dns=10000,ip-comms=5000
+	l.maxPerType = make(map[string]int)
+	perType := utils.Getenv("ALERT_STORE_MAX_PER_TYPE", "")
+	for _, entry := range strings.Split(perType, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			log.Error("Invalid ALERT_STORE_MAX_PER_TYPE entry '", entry, "', ignoring")
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || n <= 0 {
+			log.Error("Invalid ALERT_STORE_MAX_PER_TYPE limit '", entry, "', ignoring")
+			continue
+		}
+		l.maxPerType[strings.TrimSpace(kv[0])] = n
+	}
+
+	l.eviction = utils.Getenv("ALERT_STORE_EVICTION", evictSoonestExpiring)
+	switch l.eviction {
+	case evictSoonestExpiring, evictLowestProbability, evictRejectNew:
+	default:
+		log.Error("Unknown ALERT_STORE_EVICTION '", l.eviction, "', using ", evictSoonestExpiring)
+		l.eviction = evictSoonestExpiring
+	}
+}
+
+// returns true if victim should be evicted in preference to other
+func (l *alertLimits) evictBefore(victim Alert, victimTimeout int64, other Alert, otherTimeout int64) bool {
+	if l.eviction == evictLowestProbability &&
+		victim.Indicator.Probability != other.Indicator.Probability {
+		return victim.Indicator.Probability < other.Indicator.Probability
+	}
+	return victimTimeout < otherTimeout
+}
+
+// stored alert with its timeout, in an eviction queue
+type evictionEntry struct {
+	alert   Alert
+	timeout int64
+}
+
+// heap of stored alerts, the next alert to evict by the eviction policy first
+type evictionQueue struct {
+	entries []evictionEntry
+	// position of each alert in entries
+	pos    map[Alert]int
+	limits *alertLimits
+}
+
+func newEvictionQueue(l *alertLimits) *evictionQueue {
+	return &evictionQueue{pos: make(map[Alert]int), limits: l}
+}
+
+func (q *evictionQueue) Len() int { return len(q.entries) }
+
+func (q *evictionQueue) Less(i, j int) bool {
+	return q.limits.evictBefore(q.entries[i].alert, q.entries[i].timeout, q.entries[j].alert, q.entries[j].timeout)
+}
+
+func (q *evictionQueue) Swap(i, j int) {
+	q.entries[i], q.entries[j] = q.entries[j], q.entries[i]
+	q.pos[q.entries[i].alert] = i
+	q.pos[q.entries[j].alert] = j
+}
+
+func (q *evictionQueue) Push(x interface{}) {
+	e := x.(evictionEntry)
+	q.pos[e.alert] = len(q.entries)
+	q.entries = append(q.entries, e)
+}
+
+func (q *evictionQueue) Pop() interface{} {
+	e := q.entries[len(q.entries)-1]
+	q.entries = q.entries[:len(q.entries)-1]
+	delete(q.pos, e.alert)
+	return e
+}
+
+// adds the alert, or moves it for its new timeout if it is already queued
+func (q *evictionQueue) set(a Alert, timeout int64) {
+	if i, ok := q.pos[a]; ok {
+		q.entries[i].timeout = timeout
+		heap.Fix(q, i)
+		return
+	}
+	heap.Push(q, evictionEntry{alert: a, timeout: timeout})
+}
+
+func (q *evictionQueue) remove(a Alert) {
+	if i, ok := q.pos[a]; ok {
+		heap.Remove(q, i)
+	}
+}
+
+// returns the alert that would be evicted next
+func (q *evictionQueue) next() (evictionEntry, bool) {
+	if len(q.entries) == 0 {
+		return evictionEntry{}, false
+	}
+	return q.entries[0], true
+}
+
+// the stored alerts in eviction order, over the whole store and by alert type,
+// so evicting doesn't scan the store. The length of a type's queue is the
+// number of alerts of that type stored
+type evictionOrder struct {
+	all    *evictionQueue
+	byType map[string]*evictionQueue
+}
+
+func (o *evictionOrder) init(l *alertLimits) {
+	o.all = newEvictionQueue(l)
+	o.byType = make(map[string]*evictionQueue)
+}
+
+// adds a stored alert or updates its timeout
+func (o *evictionOrder) set(a Alert, timeout int64) {
+	o.all.set(a, timeout)
+	q, ok := o.byType[a.Type]
+	if !ok {
+		q = newEvictionQueue(o.all.limits)
+		o.byType[a.Type] = q
+	}
+	q.set(a, timeout)
+}
+
+func (o *evictionOrder) remove(a Alert) {
+	o.all.remove(a)
+	if q, ok := o.byType[a.Type]; ok {
+		q.remove(a)
+		if q.Len() == 0 {
+			delete(o.byType, a.Type)
+		}
+	}
+}
+
+// returns the queue for an alert type, or the whole store for no type
+func (o *evictionOrder) queue(alertType string) *evictionQueue {
+	if alertType == "" {
+		return o.all
+	}
+	if q, ok := o.byType[alertType]; ok {
+		return q
+	}
+	return newEvictionQueue(o.all.limits)
+}
+
+// returns the number of alerts of a type stored
+func (o *evictionOrder) count(alertType string) int {
+	return o.queue(alertType).Len()
+}
+
+// makes room in the alert store for a new alert with the given timeout,
+// evicting existing alerts if a limit has been reached. Returns false if the
+// new alert should not be stored
+func (dd *dynamicDetector) makeRoom(a Alert, timeout int64, source string) bool {
+	if max, ok := dd.limits.maxPerType[a.Type]; ok {
+		count := dd.evictionOrder.count(a.Type)
+		if count >= max && !dd.evict(a, timeout, count-max+1, a.Type, source) {
+			return false
+		}
+	}
+	if dd.limits.maxAlerts > 0 && len(dd.alerts) >= dd.limits.maxAlerts {
+		if !dd.evict(a, timeout, len(dd.alerts)-dd.limits.maxAlerts+1, "", source) {
+			return false
+		}
+	}
+	return true
+}
+
+// evicts n alerts (of alertType if set) to make room for the new alert a.
+// If the new alert would itself be evicted it is rejected instead and false
+// is returned. source is where the new alert came from
+func (dd *dynamicDetector) evict(a Alert, timeout int64, n int, alertType, source string) bool {
+	if dd.limits.eviction == evictRejectNew {
+		log.Warn("alert store full, rejecting new ", a.Type, " alert for ", a.Indicator.Value)
+		dd.alertsEvictedCounter.Inc(worker.MetricLabels{"analytic": pgm, "alert_type": a.Type, "policy": dd.limits.eviction})
+		dd.audit(a, alertRejected, source, 0, timeout)
+		return false
+	}
+
+	for i := 0; i < n; i++ {
+		victim, found := dd.evictionOrder.queue(alertType).next()
+		if !found || dd.limits.evictBefore(a, timeout, victim.alert, victim.timeout) {
+			log.Warn("alert store full, new ", a.Type, " alert for ", a.Indicator.Value,
+				" would be evicted first, rejecting it")
+			dd.alertsEvictedCounter.Inc(worker.MetricLabels{"analytic": pgm, "alert_type": a.Type, "policy": dd.limits.eviction})
+			dd.audit(a, alertRejected, source, 0, timeout)
+			return false
+		}
+		log.Warn("alert store full, evicting ", victim.alert.Type, " alert for ", victim.alert.Indicator.Value,
+			" using ", dd.limits.eviction, " policy")
+		victimValidFrom := dd.validFrom[victim.alert]
+		dd.removeAlert(victim.alert, alertEvicted, source)
+		dd.changes.publish(changeEvict, victim.alert, victimValidFrom, victim.timeout)
+		dd.alertsEvictedCounter.Inc(worker.MetricLabels{"analytic": pgm, "alert_type": victim.alert.Type, "policy": dd.limits.eviction})
+	}
+	return true
+}
@@ -54,7 +54,9 @@ func TestHandleNewAlert(t *testing.T) {
 }
 
 func TestTimeoutAlerts(t *testing.T) {
+	clock := newFakeClock(time.Now())
 	var dd dynamicDetector
+	dd.clock = clock
 	dd.Init()
 
 	if len(dd.alerts) != 0 {
@@ -84,11 +86,8 @@ func TestTimeoutAlerts(t *testing.T) {
 	}
 	dd.AddAlert(a)
 
-	// mock out the now function to be 15 mins in future
-	now := time.Now()
-	Now = func() time.Time {
-		return now.Add(time.Second * time.Duration(15))
-	}
+	// move the clock 15 seconds forward
+	clock.Advance(time.Second * 15)
 
 	if len(dd.alerts) != 1 {
 		t.Error("Alert has not been added to detector state")
@@ -103,7 +102,9 @@ func TestTimeoutAlerts(t *testing.T) {
 }
 
 func TestDuplicateAlertIncreaseTimeout(t *testing.T) {
+	clock := newFakeClock(time.Now())
 	var dd dynamicDetector
+	dd.clock = clock
 	dd.Init()
 
 	if len(dd.alerts) != 0 {
@@ -131,17 +132,11 @@ func TestDuplicateAlertIncreaseTimeout(t *testing.T) {
 			IP: destIpVal,
 		},
 	}
-	// mock out the now function to be 15 mins in future
-	now := time.Now()
-	Now = func() time.Time {
-		return now
-	}
+	now := clock.Now()
 	dd.AddAlert(a)
 
 	// change now time to be 5 seconds ahead
-	Now = func() time.Time {
-		return now.Add(time.Second * 5)
-	}
+	clock.Set(now.Add(time.Second * 5))
 
 	dd.AddAlert(a)
 
@@ -281,7 +276,9 @@ func TestDuplicateIOCsNotCreated(t *testing.T) {
 }
 
 func TestTimedOutEventsShouldRemoveIOCs(t *testing.T) {
+	clock := newFakeClock(time.Now())
 	var dd dynamicDetector
+	dd.clock = clock
 	dd.Init()
 
 	if len(dd.alertToIOCMap) != 0 {
@@ -312,17 +309,11 @@ func TestTimedOutEventsShouldRemoveIOCs(t *testing.T) {
 			IP: destIpVal,
 		},
 	}
-	// mock out the now function to be 15 mins in future
-	now := time.Now()
-	Now = func() time.Time {
-		return now
-	}
+	now := clock.Now()
 	dd.AddAlert(a)
 
 	// change now time to be 15 seconds ahead (past TTL)
-	Now = func() time.Time {
-		return now.Add(time.Second * 15)
-	}
+	clock.Set(now.Add(time.Second * 15))
 
 	dd.TimeoutAlerts()
 
@@ -376,7 +367,9 @@ func TestIOCsLoadedIntoDetectorLib(t *testing.T) {
 }
 
 func TestIOCsRemovedShouldBeRemovedFromDetectorLib(t *testing.T) {
+	clock := newFakeClock(time.Now())
 	var dd dynamicDetector
+	dd.clock = clock
 	dd.Init()
 
 	if dd.detectorLib.GetNumberOfNodes() != 0 {
@@ -408,16 +401,11 @@ func TestIOCsRemovedShouldBeRemovedFromDetectorLib(t *testing.T) {
 			IP: destIpVal,
 		},
 	}
-	now := time.Now()
-	Now = func() time.Time {
-		return now
-	}
+	now := clock.Now()
 	dd.AddAlert(a)
 
 	// change now time to be 15 seconds ahead (past TTL)
-	Now = func() time.Time {
-		return now.Add(time.Second * 15)
-	}
+	clock.Set(now.Add(time.Second * 15))
 
 	dd.TimeoutAlerts()
 
@@ -429,7 +417,9 @@ func TestIOCsRemovedShouldBeRemovedFromDetectorLib(t *testing.T) {
 }
 
 func TestMultiAddMultiTimeout(t *testing.T) {
+	clock := newFakeClock(time.Now())
 	var dd dynamicDetector
+	dd.clock = clock
 	dd.Init()
 
 	if len(dd.alerts) != 0 {
@@ -464,10 +454,7 @@ func TestMultiAddMultiTimeout(t *testing.T) {
 			IP: destIpVal,
 		},
 	}
-	now := time.Now()
-	Now = func() time.Time {
-		return now
-	}
+	now := clock.Now()
 	dd.AddAlert(a)
 
 	srcIp2 := "23.123.123.123"
@@ -507,9 +494,7 @@ func TestMultiAddMultiTimeout(t *testing.T) {
 	}
 
 	// change now time to be 15 seconds ahead (past 1 TTL)
-	Now = func() time.Time {
-		return now.Add(time.Second * 15)
-	}
+	clock.Set(now.Add(time.Second * 15))
 
 	dd.TimeoutAlerts()
 
@@ -521,9 +506,7 @@ func TestMultiAddMultiTimeout(t *testing.T) {
 	}
 
 	// change now time to be 25 seconds ahead (past both TTL)
-	Now = func() time.Time {
-		return now.Add(time.Second * 25)
-	}
+	clock.Set(now.Add(time.Second * 25))
 
 	dd.TimeoutAlerts()
 
@@ -538,7 +521,9 @@ func TestMultiAddMultiTimeout(t *testing.T) {
 }
 
 func TestRemovalOfIOCWithNOT(t *testing.T) {
+	clock := newFakeClock(time.Now())
 	var dd dynamicDetector
+	dd.clock = clock
 	dd.Init()
 
 	srcIp := "123.123.123.123"
@@ -583,9 +568,7 @@ func TestRemovalOfIOCWithNOT(t *testing.T) {
 	}
 
 	// change now time to be 15 seconds ahead (past TTL)
-	Now = func() time.Time {
-		return now.Add(time.Second * 15)
-	}
+	clock.Set(now.Add(time.Second * 15))
 
 	dd.TimeoutAlerts()
 
@@ -647,3 +630,418 @@ func loadIOCFromFile(filename string, t *testing.T) *ind.IndicatorNode {
 
 	return &node
 }
+
+func TestAlertStoreCapEvictsSoonestExpiring(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+	dd.limits.maxAlerts = 2
+	dd.limits.eviction = evictSoonestExpiring
+
+	a := Alert{
+		Device: "a-dev",
+		Type:   "dns",
+		Indicator: dt.Indicator{
+			Type:        "hostname",
+			Value:       "blah.com",
+			Category:    "covert.dns-tunnel",
+			Probability: 0.9,
+			Id:          "b1769a6b-80c0-40e5-9287-a9a5d4262741",
+		},
+		TTL: 10,
+	}
+	a2 := a
+	a2.Indicator.Value = "a.tunnel.com"
+	a2.TTL = 20
+	a3 := a
+	a3.Indicator.Value = "another.tunnel.com"
+	a3.TTL = 30
+
+	dd.AddAlert(a)
+	dd.AddAlert(a2)
+	dd.AddAlert(a3)
+
+	if len(dd.alerts) != 2 {
+		t.Fatal("alert store should not grow past its limit, has ", len(dd.alerts))
+	}
+	if _, ok := dd.alerts[a]; ok {
+		t.Error("alert expiring soonest should have been evicted")
+	}
+	if len(dd.alertToIOCMap) != 2 || dd.detectorLib.GetNumberOfNodes() != 6 {
+		t.Error("evicted alert's IOC should be removed from the detector")
+	}
+	dd.cleanup()
+}
+
+func TestAlertStorePerTypeCapEvictsInOrderAfterExtend(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+	dd.limits.maxPerType = map[string]int{"dns": 2}
+	dd.limits.eviction = evictSoonestExpiring
+
+	a := Alert{
+		Device: "a-dev",
+		Type:   "dns",
+		Indicator: dt.Indicator{
+			Type:        "hostname",
+			Value:       "blah.com",
+			Category:    "covert.dns-tunnel",
+			Probability: 0.9,
+			Id:          "b1769a6b-80c0-40e5-9287-a9a5d4262741",
+		},
+		TTL: 10,
+	}
+	a2 := a
+	a2.Indicator.Value = "a.tunnel.com"
+	a2.TTL = 20
+	a3 := a
+	a3.Indicator.Value = "another.tunnel.com"
+	a3.TTL = 30
+	ua := Alert{
+		Type: "useragent",
+		Indicator: dt.Indicator{
+			Type:        "useragent",
+			Value:       "Testing 123",
+			Category:    "anomaly.useragent",
+			Probability: 0.9,
+			Id:          "aaaa9a6b-80c0-40e5-9287-a9a5d4262741",
+		},
+		TTL: 5,
+	}
+
+	dd.AddAlert(a)
+	dd.AddAlert(a2)
+	dd.AddAlert(ua)
+	// extending the first alert moves it behind the second
+	clock.Advance(15 * time.Second)
+	dd.AddAlert(a)
+	dd.AddAlert(a3)
+
+	if _, ok := dd.alerts[a2]; ok {
+		t.Error("dns alert expiring soonest after the extend should have been evicted")
+	}
+	for _, kept := range []Alert{a, a3, ua} {
+		if _, ok := dd.alerts[kept]; !ok {
+			t.Error(kept.Indicator.Value, " should still be stored")
+		}
+	}
+	if dd.evictionOrder.count("dns") != 2 || dd.evictionOrder.count("useragent") != 1 {
+		t.Error("stored alerts should be counted by type")
+	}
+	dd.cleanup()
+}
+
+func TestAlertStoreCapRejectsNewAlertsExpiringFirst(t *testing.T) {
+	var dd dynamicDetector
+	dd.Init()
+	dd.limits.maxAlerts = 1
+	dd.limits.eviction = evictSoonestExpiring
+
+	a := Alert{
+		Device: "a-dev",
+		Type:   "dns",
+		Indicator: dt.Indicator{
+			Type:        "hostname",
+			Value:       "blah.com",
+			Category:    "covert.dns-tunnel",
+			Probability: 0.9,
+			Id:          "b1769a6b-80c0-40e5-9287-a9a5d4262741",
+		},
+		TTL: 30,
+	}
+	a2 := a
+	a2.Indicator.Value = "a.tunnel.com"
+	a2.TTL = 10
+
+	dd.AddAlert(a)
+	dd.AddAlert(a2)
+
+	if _, ok := dd.alerts[a]; !ok || len(dd.alerts) != 1 {
+		t.Error("new alert expiring before all stored alerts should be rejected")
+	}
+	dd.cleanup()
+}
+
+func TestAlertStoreCapEvictsLowestProbability(t *testing.T) {
+	var dd dynamicDetector
+	dd.Init()
+	dd.limits.maxAlerts = 2
+	dd.limits.eviction = evictLowestProbability
+
+	a := Alert{
+		Device: "a-dev",
+		Type:   "dns",
+		Indicator: dt.Indicator{
+			Type:        "hostname",
+			Value:       "blah.com",
+			Category:    "covert.dns-tunnel",
+			Probability: 0.9,
+			Id:          "b1769a6b-80c0-40e5-9287-a9a5d4262741",
+		},
+		TTL: 10,
+	}
+	a2 := a
+	a2.Indicator.Value = "a.tunnel.com"
+	a2.Indicator.Probability = 0.5
+	a3 := a
+	a3.Indicator.Value = "another.tunnel.com"
+	a3.Indicator.Probability = 0.7
+
+	dd.AddAlert(a)
+	dd.AddAlert(a2)
+	dd.AddAlert(a3)
+
+	if _, ok := dd.alerts[a2]; ok {
+		t.Error("alert with lowest probability should have been evicted")
+	}
+	if _, ok := dd.alerts[a3]; !ok {
+		t.Error("new alert should be stored after eviction")
+	}
+	dd.cleanup()
+}
+
+func TestAlertStorePerTypeCapRejectNew(t *testing.T) {
+	var dd dynamicDetector
+	dd.Init()
+	dd.limits.maxPerType = map[string]int{"dns": 1}
+	dd.limits.eviction = evictRejectNew
+
+	a := Alert{
+		Device: "a-dev",
+		Type:   "dns",
+		Indicator: dt.Indicator{
+			Type:        "hostname",
+			Value:       "blah.com",
+			Category:    "covert.dns-tunnel",
+			Probability: 0.9,
+			Id:          "b1769a6b-80c0-40e5-9287-a9a5d4262741",
+		},
+		TTL: 10,
+	}
+	a2 := a
+	a2.Indicator.Value = "a.tunnel.com"
+	ua := Alert{
+		Type: "useragent",
+		Indicator: dt.Indicator{
+			Type:        "useragent",
+			Value:       "Testing 123",
+			Category:    "anomaly.useragent",
+			Probability: 0.9,
+			Id:          "aaaa9a6b-80c0-40e5-9287-a9a5d4262741",
+		},
+		TTL: 10,
+	}
+
+	dd.AddAlert(a)
+	dd.AddAlert(a2)
+	dd.AddAlert(ua)
+
+	if _, ok := dd.alerts[a2]; ok {
+		t.Error("new dns alert should be rejected when dns limit reached")
+	}
+	if _, ok := dd.alerts[ua]; !ok {
+		t.Error("alert types without a limit should still be stored")
+	}
+	if len(dd.alerts) != 2 {
+		t.Error("expected 2 alerts in store, got ", len(dd.alerts))
+	}
+
+	// existing alerts can still be extended when at the limit
+	dd.AddAlert(a)
+	if _, ok := dd.alerts[a]; !ok {
+		t.Error("existing alert should remain stored")
+	}
+	dd.cleanup()
+}
+
+func TestTTLPolicyClampsTTL(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+	dd.ttlPolicy.Default = ttlRule{Max: 3600}
+	dd.ttlPolicy.Types = map[string]ttlRule{"dns": {Min: 60}}
+
+	now := clock.Now()
+
+	a := Alert{
+		Device: "a-dev",
+		Type:   "dns",
+		Indicator: dt.Indicator{
+			Type:        "hostname",
+			Value:       "blah.com",
+			Category:    "covert.dns-tunnel",
+			Probability: 0.9,
+			Id:          "b1769a6b-80c0-40e5-9287-a9a5d4262741",
+		},
+		TTL: 31536000,
+	}
+	short := a
+	short.Indicator.Value = "a.tunnel.com"
+	short.TTL = 10
+
+	dd.AddAlert(a)
+	dd.AddAlert(short)
+
+	if len(dd.alerts) != 2 {
+		t.Fatal("clamped alerts should still be stored")
+	}
+	for stored, exp := range dd.alerts {
+		switch stored.Indicator.Value {
+		case "blah.com":
+			if stored.TTL != 3600 || exp != now.Unix()+3600 {
+				t.Error("TTL above max should be clamped to the max, got ", stored.TTL)
+			}
+		case "a.tunnel.com":
+			if stored.TTL != 60 || exp != now.Unix()+60 {
+				t.Error("TTL below min should be clamped to the min, got ", stored.TTL)
+			}
+		}
+	}
+	dd.cleanup()
+}
+
+func TestTTLPolicyDefaultsMissingTTL(t *testing.T) {
+	var dd dynamicDetector
+	dd.Init()
+	dd.ttlPolicy.Categories = map[string]ttlRule{"covert.dns-tunnel": {Default: 600}}
+
+	a := Alert{
+		Device: "a-dev",
+		Type:   "dns",
+		Indicator: dt.Indicator{
+			Type:        "hostname",
+			Value:       "blah.com",
+			Category:    "covert.dns-tunnel",
+			Probability: 0.9,
+			Id:          "b1769a6b-80c0-40e5-9287-a9a5d4262741",
+		},
+	}
+	ua := Alert{
+		Type: "useragent",
+		Indicator: dt.Indicator{
+			Type:        "useragent",
+			Value:       "Testing 123",
+			Category:    "anomaly.useragent",
+			Probability: 0.9,
+			Id:          "aaaa9a6b-80c0-40e5-9287-a9a5d4262741",
+		},
+	}
+
+	dd.AddAlert(a)
+	dd.AddAlert(ua)
+
+	if len(dd.alerts) != 1 {
+		t.Fatal("only the alert with a default TTL should be stored, got ", len(dd.alerts))
+	}
+	for stored := range dd.alerts {
+		if stored.TTL != 600 {
+			t.Error("alert without a TTL should be given the category default, got ", stored.TTL)
+		}
+	}
+	dd.cleanup()
+}
+
+func TestTTLPolicyClampsDefaultTTL(t *testing.T) {
+	var dd dynamicDetector
+	dd.Init()
+	dd.ttlPolicy.Default = ttlRule{Max: 300}
+	dd.ttlPolicy.Types = map[string]ttlRule{"dns": {Default: 3600}}
+
+	a := Alert{
+		Device: "a-dev",
+		Type:   "dns",
+		Indicator: dt.Indicator{
+			Type:        "hostname",
+			Value:       "blah.com",
+			Category:    "covert.dns-tunnel",
+			Probability: 0.9,
+			Id:          "b1769a6b-80c0-40e5-9287-a9a5d4262741",
+		},
+	}
+	dd.AddAlert(a)
+
+	if len(dd.alerts) != 1 {
+		t.Fatal("alert with a default TTL should be stored, got ", len(dd.alerts))
+	}
+	for stored := range dd.alerts {
+		if stored.TTL != 300 {
+			t.Error("default TTL above the max should be clamped to the max, got ", stored.TTL)
+		}
+	}
+	dd.cleanup()
+}
+
+func TestInitialLoadCorrectsClockSkew(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+
+	now := clock.Now()
+
+	a := Alert{
+		Device: "a-dev",
+		Type:   "dns",
+		Indicator: dt.Indicator{
+			Type:        "hostname",
+			Value:       "blah.com",
+			Category:    "covert.dns-tunnel",
+			Probability: 0.9,
+			Id:          "b1769a6b-80c0-40e5-9287-a9a5d4262741",
+		},
+		TTL: 60,
+	}
+	// sender's clock is 100 seconds behind, alert has 30 seconds left
+	senderNow := now.Unix() - 100
+	am := AlertsMessage{
+		Alerts: []AlertData{{Alert: a, Timeout: senderNow + 30}},
+		Now:    senderNow,
+	}
+
+	dd.parseAlertData(am, sourcePeer)
+
+	if len(dd.alerts) != 1 {
+		t.Fatal("alert still active on sender should be loaded despite clock skew")
+	}
+	if dd.alerts[a] != now.Unix()+30 {
+		t.Error("alert timeout should be corrected for clock skew, expected ",
+			now.Unix()+30, " got ", dd.alerts[a])
+	}
+	dd.cleanup()
+}
+
+func TestInitialLoadWithoutSenderTime(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+
+	now := clock.Now()
+
+	a := Alert{
+		Device: "a-dev",
+		Type:   "dns",
+		Indicator: dt.Indicator{
+			Type:        "hostname",
+			Value:       "blah.com",
+			Category:    "covert.dns-tunnel",
+			Probability: 0.9,
+			Id:          "b1769a6b-80c0-40e5-9287-a9a5d4262741",
+		},
+		TTL: 60,
+	}
+	am := AlertsMessage{
+		Alerts: []AlertData{{Alert: a, Timeout: now.Unix() + 30}},
+	}
+
+	dd.parseAlertData(am, sourcePeer)
+
+	if dd.alerts[a] != now.Unix()+30 {
+		t.Error("timeouts from peers not sending their time should be used as is")
+	}
+	dd.cleanup()
+}
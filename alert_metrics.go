@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/worker"
+)
+
+// changes to the alert store counted by the alert lifecycle metric
+const (
+	alertAdded    = "added"
+	alertExtended = "extended"
+	alertExpired  = "expired"
+	alertRevoked  = "revoked"
+	alertEvicted  = "evicted"
+)
+
+type alertMetricKey struct {
+	alertType string
+	category  string
+}
+
+// metrics for the alert store broken down by alert type and indicator
+// category
+type alertMetrics struct {
+	active map[alertMetricKey]int
+
+	activeAlertsGauge     *worker.Gauge
+	alertChangesCounter   *worker.Counter
+	remainingTTLHistogram *prometheus.HistogramVec
+}
+
+func (m *alertMetrics) init() {
+	m.active = make(map[alertMetricKey]int)
+	m.activeAlertsGauge = worker.CreateGauge(
+		worker.GaugeOpts{
+			Name: "active_alerts",
+			Help: "number of alerts currently stored by alert type and category",
+		}, []string{"analytic", "alert_type", "category"},
+	)
+	m.alertChangesCounter = worker.CreateCounter(
+		worker.CounterOpts{
+			Name: "alert_changes",
+			Help: "number of alerts added, extended, expired, revoked or evicted",
+		}, []string{"analytic", "alert_type", "category", "change"},
+	)
+	// the worker package has no histograms so they are registered directly
+	m.remainingTTLHistogram = registerHistogram(prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "alert_remaining_ttl_seconds",
+			Help:    "remaining TTL of alerts when they are added or extended",
+			Buckets: []float64{60, 300, 900, 1800, 3600, 7200, 21600, 86400, 604800},
+		}, []string{"analytic", "alert_type", "category"},
+	))
+}
+
+func (m *alertMetrics) cleanup() {
+	worker.RemoveGauge(m.activeAlertsGauge)
+	worker.RemoveCounter(m.alertChangesCounter)
+	prometheus.Unregister(m.remainingTTLHistogram)
+}
+
+func metricKey(a Alert) alertMetricKey {
+	return alertMetricKey{alertType: a.Type, category: a.Indicator.Category}
+}
+
+func (m *alertMetrics) labels(k alertMetricKey) worker.MetricLabels {
+	return worker.MetricLabels{"analytic": pgm, "alert_type": k.alertType, "category": k.category}
+}
+
+func (m *alertMetrics) changed(k alertMetricKey, change string) {
+	labels := m.labels(k)
+	labels["change"] = change
+	m.alertChangesCounter.Inc(labels)
+}
+
+// records an alert being added or extended with its remaining TTL
+func (m *alertMetrics) stored(a Alert, change string, remaining int64) {
+	k := metricKey(a)
+	if change == alertAdded {
+		m.active[k]++
+		m.activeAlertsGauge.Set(float64(m.active[k]), m.labels(k))
+	}
+	m.changed(k, change)
+	m.remainingTTLHistogram.With(prometheus.Labels{"analytic": pgm, "alert_type": a.Type, "category": a.Indicator.Category}).Observe(float64(remaining))
+}
+
+// records an alert being removed from the store
+func (m *alertMetrics) removed(a Alert, change string) {
+	k := metricKey(a)
+	m.active[k]--
+	if m.active[k] <= 0 {
+		delete(m.active, k)
+	}
+	m.activeAlertsGauge.Set(float64(m.active[k]), m.labels(k))
+	m.changed(k, change)
+}
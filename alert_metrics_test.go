@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAlertMetricsTrackActiveAlerts(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+
+	a := testSyncAlert()
+	b := testSyncAlert()
+	b.Device = "b-dev"
+	k := metricKey(a)
+	now := clock.Now().Unix()
+
+	dd.AddExistingAlert(a, now+100)
+	dd.AddExistingAlert(b, now+100)
+	if dd.metrics.active[k] != 2 {
+		t.Error("added alerts should be counted by type and category")
+	}
+
+	dd.AddExistingAlert(a, now+200)
+	if dd.metrics.active[k] != 2 {
+		t.Error("extending an alert should not change the active count")
+	}
+
+	dd.RevokeAlert(b, sourcePeer)
+	if dd.metrics.active[k] != 1 {
+		t.Error("revoked alert should no longer be counted")
+	}
+	dd.RevokeAlert(b, sourcePeer)
+	if dd.metrics.active[k] != 1 {
+		t.Error("revoking an unknown alert should not change the count")
+	}
+
+	clock.Advance(300 * time.Second)
+	dd.TimeoutAlerts()
+	if _, ok := dd.metrics.active[k]; ok {
+		t.Error("expired alert should no longer be counted")
+	}
+	dd.cleanup()
+}
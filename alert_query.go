@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// filters and pagination for querying the alert state. Empty fields match
+// every alert
+type alertQuery struct {
+	alertType     string
+	value         string
+	category      string
+	id            string
+	device        string
+	ip            string
+	network       string
+	expiresAfter  int64
+	expiresBefore int64
+	// digest bucket the alert key is in, -1 for all buckets
+	bucket int
+
+	// maximum number of alerts to return, 0 returns all of them
+	limit int
+	// only alerts with a key after the cursor are returned
+	cursor string
+}
+
+func parseAlertQuery(v url.Values) (alertQuery, error) {
+	q := alertQuery{
+		alertType: v.Get("type"),
+		value:     v.Get("value"),
+		category:  v.Get("category"),
+		id:        v.Get("id"),
+		device:    v.Get("device"),
+		ip:        v.Get("ip"),
+		network:   v.Get("network"),
+		cursor:    v.Get("cursor"),
+		bucket:    -1,
+	}
+
+	var err error
+	if s := v.Get("expires_after"); s != "" {
+		q.expiresAfter, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return q, errors.New("expires_after must be a unix time in seconds")
+		}
+	}
+	if s := v.Get("expires_before"); s != "" {
+		q.expiresBefore, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return q, errors.New("expires_before must be a unix time in seconds")
+		}
+	}
+	if s := v.Get("bucket"); s != "" {
+		q.bucket, err = strconv.Atoi(s)
+		if err != nil || q.bucket < 0 || q.bucket >= digestBuckets {
+			return q, errors.New("bucket must be between 0 and " + strconv.Itoa(digestBuckets-1))
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		q.limit, err = strconv.Atoi(s)
+		if err != nil || q.limit < 0 {
+			return q, errors.New("limit must be a positive number")
+		}
+	}
+	return q, nil
+}
+
+// IPs on alerts are stored with their type e.g. ipv4:1.2.3.4, the query can
+// give the IP with or without the type
+func matchesIP(info CommsInfo, ip string) bool {
+	if info.IP == "" {
+		return false
+	}
+	if info.IP == ip {
+		return true
+	}
+	parts := strings.SplitN(info.IP, ":", 2)
+	return len(parts) == 2 && parts[1] == ip
+}
+
+func (q *alertQuery) matches(a Alert, timeout int64) bool {
+	switch {
+	case q.alertType != "" && a.Type != q.alertType:
+		return false
+	case q.value != "" && a.Indicator.Value != q.value:
+		return false
+	case q.category != "" && a.Indicator.Category != q.category:
+		return false
+	case q.id != "" && a.Indicator.Id != q.id:
+		return false
+	case q.device != "" && a.Device != q.device:
+		return false
+	case q.network != "" && a.Network != q.network:
+		return false
+	case q.ip != "" && !matchesIP(a.Src, q.ip) && !matchesIP(a.Dest, q.ip):
+		return false
+	case q.expiresAfter != 0 && timeout <= q.expiresAfter:
+		return false
+	case q.expiresBefore != 0 && timeout >= q.expiresBefore:
+		return false
+	}
+	return true
+}
+
+// index of the stored alerts by key, so queries do not work out the key of
+// every alert and sort them. Maintained with the alert state, the state lock
+// must be held
+type alertIndex struct {
+	alerts map[string]Alert
+	// keys of the stored alerts in order
+	keys []string
+}
+
+func (x *alertIndex) init() {
+	x.alerts = make(map[string]Alert)
+	x.keys = make([]string, 0)
+}
+
+func (x *alertIndex) add(key string, a Alert) {
+	if _, ok := x.alerts[key]; ok {
+		return
+	}
+	x.alerts[key] = a
+	i := sort.SearchStrings(x.keys, key)
+	x.keys = append(x.keys, "")
+	copy(x.keys[i+1:], x.keys[i:])
+	x.keys[i] = key
+}
+
+func (x *alertIndex) remove(key string) {
+	if _, ok := x.alerts[key]; !ok {
+		return
+	}
+	delete(x.alerts, key)
+	i := sort.SearchStrings(x.keys, key)
+	if i < len(x.keys) && x.keys[i] == key {
+		x.keys = append(x.keys[:i], x.keys[i+1:]...)
+	}
+}
+
+func (x *alertIndex) get(key string) (Alert, bool) {
+	a, ok := x.alerts[key]
+	return a, ok
+}
+
+// returns the keys after the cursor in order, all of them for no cursor
+func (x *alertIndex) after(cursor string) []string {
+	if cursor == "" {
+		return x.keys
+	}
+	return x.keys[sort.Search(len(x.keys), func(i int) bool { return x.keys[i] > cursor }):]
+}
+
+// returns the keys from the key on in order, including the key itself
+func (x *alertIndex) from(key string) []string {
+	return x.keys[sort.SearchStrings(x.keys, key):]
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
+	streadway "github.com/streadway/amqp"
 	"github.com/trustnetworks/analytics-common/amqp"
 	"github.com/trustnetworks/analytics-common/utils"
 	"github.com/trustnetworks/analytics-common/worker"
@@ -18,7 +19,8 @@ type AlertReceiver struct {
 	exchange string
 	queue    string
 
-	ctx context.Context
+	ctx    context.Context
+	status *detectorStatus
 
 	alertsUnreadableCounter *worker.Counter
 	alertsReceivedCounter   *worker.Counter
@@ -57,12 +59,13 @@ func (a *AlertReceiver) init(ctx context.Context) {
 	a.ctx = ctx
 }
 
-func RegisterForAlerts(ctx context.Context) (<-chan Alert, <-chan error) {
+func RegisterForAlerts(ctx context.Context, status *detectorStatus) (<-chan Alert, <-chan error) {
 	ch := make(chan Alert, 100)
 	eCh := make(chan error, 1)
 
 	var ar AlertReceiver
 	ar.init(ctx)
+	ar.status = status
 	go ar.consume(ch, eCh)
 	return ch, eCh
 }
@@ -99,16 +102,59 @@ func (ar *AlertReceiver) consume(ch chan Alert, eCh chan error) {
 		ch <- a
 
 		// Record statss
-		go func() {
-			lbls := worker.MetricLabels{"analytic": pgm, "exchange": ar.exchange, "queue": ar.queue, "type": "amqp", "alert_type": a.Type}
-			ar.alertsReceivedCounter.Inc(lbls)
-		}()
+		lbls := worker.MetricLabels{"analytic": pgm, "exchange": ar.exchange, "queue": ar.queue, "type": "amqp", "alert_type": a.Type}
+		ar.alertsReceivedCounter.Inc(lbls)
 	}
 
+	// the consumer connects, and reconnects, inside Consume without saying
+	// whether it is connected, so the broker is watched separately
+	ctx, cancel := context.WithCancel(ar.ctx)
+	watching := make(chan bool)
+	go func() {
+		defer close(watching)
+		ar.watchBroker(ctx)
+	}()
 	err := consumer.Consume(handler)
+	cancel()
+	<-watching
+	ar.status.set(checkAlertConsumer, false, "alert consumer stopped")
 	if err != nil {
 		log.Errorf("error: Error in reading from queue: %s", err.Error())
 		eCh <- errors.New("alert receiver quit unexpectedly")
 	}
 
 }
+
+// holds a connection of its own to the broker the consumer uses, reporting the
+// consumer healthy only whilst the broker can be reached. Reconnects with
+// backoff until the context is done
+func (ar *AlertReceiver) watchBroker(ctx context.Context) {
+	backoff := time.Second
+	for {
+		ar.status.set(checkAlertConsumer, false, "connecting to the broker")
+		conn, err := streadway.Dial(ar.broker)
+		if err == nil {
+			backoff = time.Second
+			ar.status.set(checkAlertConsumer, true, "consuming alerts from "+ar.exchange)
+			closed := conn.NotifyClose(make(chan *streadway.Error, 1))
+			select {
+			case <-closed:
+				log.Warn("lost connection to the broker")
+			case <-ctx.Done():
+				conn.Close()
+				return
+			}
+		} else {
+			log.Warn("Couldn't connect to the broker: ", err.Error())
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
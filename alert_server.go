@@ -1,46 +1,293 @@
 package main
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
 	log "github.com/sirupsen/logrus"
+	"github.com/trustnetworks/analytics-common/utils"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 type alertServer struct {
-	alerts *map[Alert]int64
+	dd *dynamicDetector
+
+	// TLS is used if a certificate is configured, client certificates are
+	// required if a client CA is configured
+	tlsCert     string
+	tlsKey      string
+	tlsClientCA string
+	// bearer token required on requests, if set
+	token string
+	// port the probes are also served on over plain HTTP, without client
+	// certificates, so the kubelet can call them when mTLS is enabled
+	probePort string
+}
+
+func (as *alertServer) init(dd *dynamicDetector) {
+	as.dd = dd
+	as.tlsCert = utils.Getenv("ALERT_SERVER_TLS_CERT", "")
+	as.tlsKey = utils.Getenv("ALERT_SERVER_TLS_KEY", "")
+	as.tlsClientCA = utils.Getenv("ALERT_SERVER_CLIENT_CA", "")
+	as.token = utils.Getenv("ALERT_SERVER_TOKEN", "")
+	as.probePort = utils.Getenv("PROBE_PORT", "8082")
 }
 
-func (as *alertServer) initAlertServer(alerts *map[Alert]int64) {
-	as.alerts = alerts
+func (as *alertServer) initAlertServer(dd *dynamicDetector) {
+	as.init(dd)
 
 	go as.run()
+	go as.runProbes()
+}
+
+// serves the liveness and readiness probes only
+func (as *alertServer) probeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", as.handleHealthz)
+	mux.HandleFunc("/readyz", as.handleReadyz)
+	return mux
+}
+
+func (as *alertServer) runProbes() {
+	log.Info("starting probe server on port ", as.probePort)
+	server := &http.Server{Addr: ":" + as.probePort, Handler: as.probeMux()}
+	log.Fatal(server.ListenAndServe())
 }
 
 func (as *alertServer) run() {
 	log.Info("starting alert server")
-	http.HandleFunc("/alerts", as.handle)
-	log.Fatal(http.ListenAndServe(":8081", nil))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/alerts", as.authenticated(as.afterLoad(as.handle)))
+	mux.HandleFunc("/alerts/", as.authenticated(as.afterLoad(as.handleAlert)))
+	mux.HandleFunc("/alerts/stream", as.authenticated(as.afterLoad(as.handleStream)))
+	mux.HandleFunc("/alerts/digest", as.authenticated(as.afterLoad(as.handleDigest)))
+	mux.HandleFunc("/alerts/repair", as.authenticated(as.writable(as.afterLoad(as.handleRepair))))
+	mux.HandleFunc("/alerts/history", as.authenticated(as.afterLoad(as.handleHistory)))
+	mux.HandleFunc("/admin/iocs", as.authenticated(as.handleIOCs))
+	mux.HandleFunc("/admin/iocs/", as.authenticated(as.handleIOC))
+	mux.HandleFunc("/admin/explain", as.authenticated(as.handleExplain))
+	// probes are not authenticated so the kubelet can call them
+	mux.HandleFunc("/healthz", as.handleHealthz)
+	mux.HandleFunc("/readyz", as.handleReadyz)
+
+	server := &http.Server{Addr: ":8081", Handler: mux}
+	if as.tlsCert == "" {
+		if as.token != "" {
+			log.Warn("alert server token is sent without TLS")
+		}
+		log.Fatal(server.ListenAndServe())
+	}
+
+	server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if as.tlsClientCA != "" {
+		pool, err := loadCertPool(as.tlsClientCA)
+		if err != nil {
+			log.Fatal("Couldn't load ALERT_SERVER_CLIENT_CA: ", err.Error())
+		}
+		server.TLSConfig.ClientCAs = pool
+		server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	log.Fatal(server.ListenAndServeTLS(as.tlsCert, as.tlsKey))
+}
+
+// wraps a handler to require the bearer token, if one is configured
+func (as *alertServer) authenticated(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if as.token != "" {
+			auth := r.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "Bearer ") ||
+				subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(as.token)) != 1 {
+				log.Warn("unauthorised request for ", r.URL.Path, " from ", r.RemoteAddr)
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorised", http.StatusUnauthorized)
+				return
+			}
+		}
+		h(w, r)
+	}
 }
 
-func (as *alertServer) getAlertData() AlertsMessage {
+// wraps a handler that changes our alerts so that it is refused unless
+// callers have to prove who they are, with the token or a client certificate
+func (as *alertServer) writable(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if as.token == "" && (as.tlsCert == "" || as.tlsClientCA == "") {
+			log.Warn("refused ", r.URL.Path, " from ", r.RemoteAddr, ", writes need ALERT_SERVER_TOKEN or ALERT_SERVER_CLIENT_CA")
+			http.Error(w, "writes are disabled without a token or client certificates", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// returns the alerts matching the query, ordered by key so that a cursor
+// (the key of the last alert returned) gives a stable position to continue
+// from on the next page
+func (as *alertServer) getAlertData(q alertQuery) AlertsMessage {
 	var alerts AlertsMessage
 	alerts.Alerts = make([]AlertData, 0)
-	for k, v := range *(as.alerts) {
-		alerts.Alerts = append(alerts.Alerts, AlertData{Alert: k, Timeout: v})
+
+	as.dd.lock.RLock()
+	alerts.Now = as.dd.clock.Now().Unix()
+	for _, key := range as.dd.index.after(q.cursor) {
+		if q.bucket >= 0 && digestBucket(key) != q.bucket {
+			continue
+		}
+		a, _ := as.dd.index.get(key)
+		timeout := as.dd.alerts[a]
+		if !q.matches(a, timeout) {
+			continue
+		}
+		if q.limit > 0 && len(alerts.Alerts) == q.limit {
+			alerts.Next = alerts.Alerts[q.limit-1].Key
+			break
+		}
+		alerts.Alerts = append(alerts.Alerts, AlertData{Key: key, Alert: a, Timeout: timeout, ValidFrom: as.dd.validFrom[a]})
 	}
+	as.dd.lock.RUnlock()
 
 	return alerts
 }
 
-func (as *alertServer) handle(w http.ResponseWriter, r *http.Request) {
-	log.Info("Another dynamic detector is requesting an initial load, returning current state")
-	alerts := as.getAlertData()
-	js, err := json.Marshal(alerts)
+// returns the alert with the given key
+func (as *alertServer) getAlert(key string) (AlertData, bool) {
+	as.dd.lock.RLock()
+	defer as.dd.lock.RUnlock()
+	a, ok := as.dd.index.get(key)
+	if !ok {
+		return AlertData{}, false
+	}
+	return AlertData{Key: key, Alert: a, Timeout: as.dd.alerts[a], ValidFrom: as.dd.validFrom[a]}, true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	js, err := json.Marshal(v)
 	if err != nil {
-		log.Error("Error marshalling current state to send alerts to other dynamic detector: ", err.Error())
+		log.Error("Error marshalling alert server response: ", err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Write(js)
 }
+
+func (as *alertServer) handle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.RawQuery == "" {
+		log.Info("Another dynamic detector is requesting an initial load, returning current state")
+	}
+	q, err := parseAlertQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = writeAlerts(w, r, as.getAlertData(q))
+	if err != nil {
+		log.Error("Error sending alert state: ", err.Error())
+	}
+}
+
+// single alert lookup, /alerts/<key>, or revoke with DELETE
+func (as *alertServer) handleAlert(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "DELETE" {
+		as.writable(as.handleRevoke)(w, r)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/alerts/")
+	alert, ok := as.getAlert(key)
+	if !ok {
+		http.Error(w, "alert not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, alert)
+}
+
+// revokes the alert with the key, DELETE /alerts/{key}. The revoke is streamed
+// to peers like any other change
+func (as *alertServer) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/alerts/")
+	alert, ok := as.getAlert(key)
+	if !ok || !as.dd.RevokeAlert(alert.Alert, sourceHTTP) {
+		http.Error(w, "alert not found", http.StatusNotFound)
+		return
+	}
+	log.Info("alert ", key, " revoked by ", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// digest of the alert state for anti-entropy between replicas
+func (as *alertServer) handleDigest(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, as.dd.digest())
+}
+
+// streams the alert state as newline delimited JSON changes. A snapshot of
+// the current state is sent followed by live changes, unless the client gives
+// a feed and sequence number that can be resumed from
+func (as *alertServer) handleStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	since, _ := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+	feed := r.URL.Query().Get("feed")
+
+	// hold the state lock so no changes are published between taking the
+	// snapshot and subscribing
+	as.dd.lock.RLock()
+	ch, backlog, seq, resumed := as.dd.changes.subscribe(feed, since)
+	if !resumed {
+		now := as.dd.clock.Now().Unix()
+		backlog = make([]AlertChange, 0, len(as.dd.alerts)+1)
+		for k, v := range as.dd.alerts {
+			a := k
+			backlog = append(backlog, AlertChange{Feed: as.dd.changes.id, Seq: seq, Op: changeSnapshot,
+				Key: a.Key(), Alert: &a, Timeout: v, ValidFrom: as.dd.validFrom[k], Now: now})
+		}
+		backlog = append(backlog, AlertChange{Feed: as.dd.changes.id, Seq: seq, Op: changeSynced, Now: now})
+	}
+	as.dd.lock.RUnlock()
+	defer as.dd.changes.unsubscribe(ch)
+
+	if resumed {
+		log.Info("resuming alert stream from change ", since)
+	} else {
+		log.Info("streaming snapshot of ", len(backlog)-1, " alerts")
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set(replicaHeader, as.dd.hostname)
+	enc := json.NewEncoder(w)
+	for _, c := range backlog {
+		if err := enc.Encode(c); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := as.dd.clock.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		var c AlertChange
+		select {
+		case <-r.Context().Done():
+			return
+		case change, ok := <-ch:
+			if !ok {
+				log.Warn("alert stream client too slow, closing stream")
+				return
+			}
+			c = change
+		case <-heartbeat.C():
+			c = AlertChange{Feed: as.dd.changes.id, Seq: seq, Op: changeHeartbeat, Now: as.dd.clock.Now().Unix()}
+		}
+		if c.Op != changeHeartbeat {
+			seq = c.Seq
+		}
+		if err := enc.Encode(c); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	dt "github.com/trustnetworks/analytics-common/datatypes"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAlertServer(t *testing.T) (*alertServer, Alert, Alert) {
+	clock := newFakeClock(time.Now())
+	now := clock.Now()
+
+	vpnAlert := Alert{
+		Device:  "a-dev",
+		Network: "vpn",
+		Type:    "dns",
+		Indicator: dt.Indicator{
+			Type:        "hostname",
+			Value:       "blah.com",
+			Category:    "covert.dns-tunnel",
+			Probability: 0.9,
+			Id:          "b1769a6b-80c0-40e5-9287-a9a5d4262741",
+		},
+		TTL: 300,
+		Src: CommsInfo{
+			IP: "ipv4:10.8.0.44",
+		},
+		Dest: CommsInfo{
+			IP: "ipv4:8.8.8.8",
+		},
+	}
+	officeAlert := vpnAlert
+	officeAlert.Network = "office"
+	officeAlert.Device = "another-dev"
+	officeAlert.Src.IP = "ipv4:10.8.0.45"
+
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+	dd.AddExistingAlert(vpnAlert, now.Unix()+100)
+	dd.AddExistingAlert(officeAlert, now.Unix()+200)
+
+	var as alertServer
+	as.dd = &dd
+	return &as, vpnAlert, officeAlert
+}
+
+func queryAlertServer(as *alertServer, url string, t *testing.T) AlertsMessage {
+	rec := httptest.NewRecorder()
+	as.handle(rec, httptest.NewRequest("GET", url, nil))
+
+	var am AlertsMessage
+	err := json.Unmarshal(rec.Body.Bytes(), &am)
+	if err != nil {
+		t.Fatal("JSON unmarshal error: ", err.Error(), " body: ", rec.Body.String())
+	}
+	return am
+}
+
+func TestAlertServerFiltersByNetwork(t *testing.T) {
+	as, _, _ := testAlertServer(t)
+
+	am := queryAlertServer(as, "/alerts?network=vpn", t)
+	if len(am.Alerts) != 1 {
+		t.Fatal("only alerts for the requested network should be returned, got ", len(am.Alerts))
+	}
+	if am.Alerts[0].Alert.Network != "vpn" || am.Alerts[0].Timeout != as.dd.clock.Now().Unix()+100 {
+		t.Error("wrong alert returned for network filter: ", am.Alerts[0])
+	}
+
+	am = queryAlertServer(as, "/alerts", t)
+	if len(am.Alerts) != 2 {
+		t.Error("all alerts should be returned when no network is given")
+	}
+	as.dd.cleanup()
+}
+
+func TestAlertServerFilters(t *testing.T) {
+	as, vpnAlert, _ := testAlertServer(t)
+
+	tests := []struct {
+		query    string
+		expected int
+	}{
+		{"/alerts?type=dns", 2},
+		{"/alerts?type=ip-comms", 0},
+		{"/alerts?value=blah.com", 2},
+		{"/alerts?category=covert.dns-tunnel", 2},
+		{"/alerts?id=b1769a6b-80c0-40e5-9287-a9a5d4262741", 2},
+		{"/alerts?device=a-dev", 1},
+		{"/alerts?ip=10.8.0.45", 1},
+		{"/alerts?ip=ipv4:8.8.8.8", 2},
+		{"/alerts?ip=1.2.3.4", 0},
+		{"/alerts?expires_before=" + itoa(as.dd.clock.Now().Unix()+150), 1},
+		{"/alerts?expires_after=" + itoa(as.dd.clock.Now().Unix()+150), 1},
+	}
+	for _, test := range tests {
+		am := queryAlertServer(as, test.query, t)
+		if len(am.Alerts) != test.expected {
+			t.Error(test.query, " should return ", test.expected, " alerts, got ", len(am.Alerts))
+		}
+	}
+
+	am := queryAlertServer(as, "/alerts?device=a-dev", t)
+	if len(am.Alerts) == 1 && am.Alerts[0].Key != vpnAlert.Key() {
+		t.Error("alerts returned should include their key")
+	}
+
+	rec := httptest.NewRecorder()
+	as.handle(rec, httptest.NewRequest("GET", "/alerts?limit=lots", nil))
+	if rec.Code != 400 {
+		t.Error("invalid query should be rejected")
+	}
+	as.dd.cleanup()
+}
+
+func TestAlertServerPagination(t *testing.T) {
+	as, _, _ := testAlertServer(t)
+
+	first := queryAlertServer(as, "/alerts?limit=1", t)
+	if len(first.Alerts) != 1 || first.Next == "" {
+		t.Fatal("first page should have 1 alert and a cursor for the next page")
+	}
+	second := queryAlertServer(as, "/alerts?limit=1&cursor="+first.Next, t)
+	if len(second.Alerts) != 1 {
+		t.Fatal("second page should have 1 alert")
+	}
+	if second.Alerts[0].Key == first.Alerts[0].Key {
+		t.Error("pages should not repeat alerts")
+	}
+	if second.Next != "" {
+		third := queryAlertServer(as, "/alerts?limit=1&cursor="+second.Next, t)
+		if len(third.Alerts) != 0 {
+			t.Error("should be no alerts after the last page")
+		}
+	}
+	as.dd.cleanup()
+}
+
+func TestAlertServerSingleAlertLookup(t *testing.T) {
+	as, vpnAlert, _ := testAlertServer(t)
+
+	rec := httptest.NewRecorder()
+	as.handleAlert(rec, httptest.NewRequest("GET", "/alerts/"+vpnAlert.Key(), nil))
+
+	var ad AlertData
+	err := json.Unmarshal(rec.Body.Bytes(), &ad)
+	if err != nil {
+		t.Fatal("JSON unmarshal error: ", err.Error())
+	}
+	if ad.Alert != vpnAlert {
+		t.Error("lookup should return the alert with the key requested")
+	}
+
+	rec = httptest.NewRecorder()
+	as.handleAlert(rec, httptest.NewRequest("GET", "/alerts/not-a-key", nil))
+	if rec.Code != 404 {
+		t.Error("unknown alert key should return not found")
+	}
+
+	as.dd.RevokeAlert(vpnAlert, sourcePeer)
+	rec = httptest.NewRecorder()
+	as.handleAlert(rec, httptest.NewRequest("GET", "/alerts/"+vpnAlert.Key(), nil))
+	if rec.Code != 404 || len(as.dd.index.keys) != 1 {
+		t.Error("removed alert should be removed from the key index")
+	}
+	as.dd.cleanup()
+}
+
+func itoa(i int64) string {
+	return strconv.FormatInt(i, 10)
+}
+
+func TestAlertServerContentNegotiation(t *testing.T) {
+	as, vpnAlert, _ := testAlertServer(t)
+
+	req := httptest.NewRequest("GET", "/alerts?device=a-dev", nil)
+	setAlertsRequestHeaders(req)
+	rec := httptest.NewRecorder()
+	as.handle(rec, req)
+
+	resp := rec.Result()
+	if resp.Header.Get("Content-Type") != gobContentType {
+		t.Error("binary encoding should be used when accepted, got ", resp.Header.Get("Content-Type"))
+	}
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Error("response should be compressed when gzip accepted")
+	}
+
+	var am AlertsMessage
+	err := decodeAlerts(resp, &am)
+	if err != nil {
+		t.Fatal("couldn't decode alerts: ", err.Error())
+	}
+	if len(am.Alerts) != 1 || am.Alerts[0].Alert != vpnAlert {
+		t.Error("decoded alerts do not match the alert state")
+	}
+
+	// clients that do not ask for anything get uncompressed JSON
+	rec = httptest.NewRecorder()
+	as.handle(rec, httptest.NewRequest("GET", "/alerts", nil))
+	if rec.Result().Header.Get("Content-Encoding") != "" {
+		t.Error("response should not be compressed unless asked for")
+	}
+	am = AlertsMessage{}
+	err = json.Unmarshal(rec.Body.Bytes(), &am)
+	if err != nil || len(am.Alerts) != 2 {
+		t.Error("default response should be JSON of all alerts")
+	}
+	as.dd.cleanup()
+}
+
+func TestHeaderAccepts(t *testing.T) {
+	if !headerAccepts("gzip, deflate", "gzip") {
+		t.Error("gzip should be accepted")
+	}
+	if headerAccepts("deflate, gzip;q=0", "gzip") {
+		t.Error("gzip with q=0 should not be accepted")
+	}
+	if !headerAccepts("application/x-gob, application/json;q=0.9", "application/json") {
+		t.Error("json with a quality value should be accepted")
+	}
+}
+
+func TestAlertServerRequiresToken(t *testing.T) {
+	as, _, _ := testAlertServer(t)
+	as.token = "a-secret"
+	handler := as.authenticated(as.handle)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/alerts", nil))
+	if rec.Code != 401 {
+		t.Error("request without token should be rejected, got ", rec.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/alerts", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != 401 {
+		t.Error("request with wrong token should be rejected, got ", rec.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/alerts", nil)
+	req.Header.Set("Authorization", "Bearer a-secret")
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != 200 {
+		t.Error("request with token should be allowed, got ", rec.Code)
+	}
+	as.dd.cleanup()
+}
+
+func TestAlertServerWritesNeedCredentials(t *testing.T) {
+	as, _, _ := testAlertServer(t)
+	handler := as.writable(as.handleRepair)
+	repair := func() int {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("POST", "/alerts/repair", strings.NewReader(`{"alerts":[]}`)))
+		return rec.Code
+	}
+
+	if code := repair(); code != 403 {
+		t.Error("repair without a token or client certificates should be refused, got ", code)
+	}
+	// TLS alone doesn't say who the caller is
+	as.tlsCert = "cert.pem"
+	if code := repair(); code != 403 {
+		t.Error("repair with TLS but no client certificates should be refused, got ", code)
+	}
+	as.tlsClientCA = "ca.pem"
+	if code := repair(); code != 204 {
+		t.Error("repair with client certificates should be allowed, got ", code)
+	}
+	as.tlsCert, as.tlsClientCA = "", ""
+	as.token = "a-secret"
+	if code := repair(); code != 204 {
+		t.Error("repair with a token should be allowed, got ", code)
+	}
+	as.dd.cleanup()
+}
+
+func TestPeerClientURLsFollowTLS(t *testing.T) {
+	var pc peerClient
+	pc.init()
+	if pc.defaultPeerURL() != "http://dynamicdetector:8081" || pc.checkURL("http://peer:8081") != nil {
+		t.Error("plain http peers should be used without TLS")
+	}
+
+	pc.scheme = "https"
+	if pc.defaultPeerURL() != "https://dynamicdetector:8081" {
+		t.Error("default peer URL should use https with TLS, got ", pc.defaultPeerURL())
+	}
+	if pc.checkURL("http://peer:8081") == nil {
+		t.Error("plain http peer should be refused with TLS")
+	}
+	if pc.checkURL("https://peer:8081") != nil {
+		t.Error("https peer should be allowed with TLS")
+	}
+}
+
+func TestPeerClientSendsToken(t *testing.T) {
+	as, _, _ := testAlertServer(t)
+	as.token = "a-secret"
+	server := httptest.NewServer(as.authenticated(as.handle))
+	defer server.Close()
+
+	var pc peerClient
+	pc.init()
+	pc.token = "a-secret"
+	am, err := fetchPeerState(context.Background(), &pc, server.URL)
+	if err != nil {
+		t.Fatal("peer with token should be able to load state: ", err.Error())
+	}
+	if len(am.Alerts) != 2 {
+		t.Error("expected 2 alerts from peer, got ", len(am.Alerts))
+	}
+
+	pc.token = ""
+	_, err = fetchPeerState(context.Background(), &pc, server.URL)
+	if err == nil {
+		t.Error("peer without token should not be able to load state")
+	}
+	as.dd.cleanup()
+}
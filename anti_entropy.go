@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/trustnetworks/analytics-common/utils"
+	"github.com/trustnetworks/analytics-common/worker"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// number of buckets alerts are hashed into for comparing state
+	digestBuckets = 64
+	// remaining TTLs are truncated to this many seconds in digests, so that
+	// alerts received at slightly different times on each replica usually
+	// match
+	digestTTLResolution = 60
+	// maximum size of alerts pushed by a peer
+	maxRepairSize = 16 << 20
+)
+
+// hashes of the alert state, one per bucket of alert keys
+type AlertDigest struct {
+	Buckets []string `json:"buckets"`
+}
+
+// bucket an alert key belongs in
+func digestBucket(key string) int {
+	n, err := strconv.ParseUint(key[:4], 16, 64)
+	if err != nil {
+		return 0
+	}
+	return int(n % digestBuckets)
+}
+
+// works out the digest of the current alert state. Each bucket is the XOR of
+// hashes of the alert keys and remaining TTL in it, so it does not depend on
+// the order alerts are visited or on the clock of the replica
+func (dd *dynamicDetector) digest() AlertDigest {
+	sums := make([][16]byte, digestBuckets)
+
+	dd.lock.RLock()
+	now := dd.clock.Now().Unix()
+	for key, a := range dd.index.alerts {
+		timeout := dd.alerts[a]
+		if timeout <= now {
+			continue
+		}
+		remaining := (timeout - now) / digestTTLResolution
+		h := sha256.Sum256([]byte(key + ":" + strconv.FormatInt(remaining, 10)))
+		b := digestBucket(key)
+		for i := range sums[b] {
+			sums[b][i] ^= h[i]
+		}
+	}
+	dd.lock.RUnlock()
+
+	d := AlertDigest{Buckets: make([]string, digestBuckets)}
+	for i := range sums {
+		d.Buckets[i] = hex.EncodeToString(sums[i][:])
+	}
+	return d
+}
+
+// periodically compares the alert state with a peer. Alerts in buckets that
+// differ are pulled from the peer, and alerts the peer is missing or has an
+// earlier timeout for are pushed to it, so both replicas converge
+type antiEntropy struct {
+	dd       *dynamicDetector
+	peerURL  string
+	interval time.Duration
+	// alerts to repair, pulled from or pushed by a peer
+	repairs chan AlertChange
+
+	divergentBucketsCounter *worker.Counter
+	alertsRepairedCounter   *worker.Counter
+	alertsPushedCounter     *worker.Counter
+}
+
+func (ae *antiEntropy) init(dd *dynamicDetector) {
+	ae.dd = dd
+	ae.peerURL = dd.peerURL
+
+	interval, err := strconv.Atoi(utils.Getenv("ANTI_ENTROPY_INTERVAL", "60"))
+	if err != nil {
+		log.Error("Invalid ANTI_ENTROPY_INTERVAL, using 60 seconds")
+		interval = 60
+	}
+	ae.interval = time.Duration(interval) * time.Second
+	ae.repairs = make(chan AlertChange, 100)
+
+	ae.divergentBucketsCounter = worker.CreateCounter(
+		worker.CounterOpts{
+			Name: "anti_entropy_divergent_buckets",
+			Help: "number of alert digest buckets found to differ from a peer",
+		}, []string{"analytic"},
+	)
+	ae.alertsRepairedCounter = worker.CreateCounter(
+		worker.CounterOpts{
+			Name: "anti_entropy_alerts_repaired",
+			Help: "number of alerts added or extended after comparing state with a peer",
+		}, []string{"analytic"},
+	)
+	ae.alertsPushedCounter = worker.CreateCounter(
+		worker.CounterOpts{
+			Name: "anti_entropy_alerts_pushed",
+			Help: "number of alerts pushed to a peer that was missing them or had an earlier timeout",
+		}, []string{"analytic"},
+	)
+}
+
+func (ae *antiEntropy) cleanup() {
+	worker.RemoveCounter(ae.divergentBucketsCounter)
+	worker.RemoveCounter(ae.alertsRepairedCounter)
+	worker.RemoveCounter(ae.alertsPushedCounter)
+}
+
+// runs anti-entropy until the context is done, alerts to repair are passed
+// to the returned channel to be applied by the event handling goroutine
+func (ae *antiEntropy) run(ctx context.Context) <-chan AlertChange {
+	ch := ae.repairs
+	if ae.interval <= 0 {
+		log.Info("anti-entropy disabled")
+		return ch
+	}
+	go func() {
+		ticker := ae.dd.clock.NewTicker(ae.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C():
+				err := ae.reconcile(ctx, ch)
+				if err != nil {
+					log.Warn("anti-entropy with ", ae.peerURL, " failed: ", err.Error())
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+func (ae *antiEntropy) reconcile(ctx context.Context, ch chan<- AlertChange) error {
+	var peerDigest AlertDigest
+	err := getPeerJSON(ctx, &ae.dd.peerClient, ae.peerURL+"/alerts/digest", &peerDigest)
+	if err != nil {
+		return err
+	}
+	if len(peerDigest.Buckets) != digestBuckets {
+		return errors.New("peer digest has wrong number of buckets")
+	}
+
+	digest := ae.dd.digest()
+	divergent := 0
+	for b := range digest.Buckets {
+		if digest.Buckets[b] == peerDigest.Buckets[b] {
+			continue
+		}
+		divergent++
+		ae.divergentBucketsCounter.Inc(worker.MetricLabels{"analytic": pgm})
+
+		am, err := fetchPeerAlerts(ctx, &ae.dd.peerClient, ae.peerURL+"/alerts?bucket="+strconv.Itoa(b))
+		if err != nil {
+			return err
+		}
+		for _, c := range ae.dd.localChanges(am) {
+			select {
+			case ch <- c:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		// pulling only extends our copy, the peer needs ours where it is
+		// later for the bucket to converge
+		push := ae.dd.laterThan(b, am)
+		if len(push.Alerts) > 0 {
+			err = postPeerJSON(ctx, &ae.dd.peerClient, ae.peerURL+"/alerts/repair", push)
+			if err != nil {
+				return err
+			}
+			for range push.Alerts {
+				ae.alertsPushedCounter.Inc(worker.MetricLabels{"analytic": pgm})
+			}
+		}
+	}
+	if divergent > 0 {
+		log.Info("alert state differs from peer in ", divergent, " of ", digestBuckets, " buckets")
+	}
+	return nil
+}
+
+// returns the alerts in a bucket that a peer's copy of the bucket is missing
+// or has an earlier timeout for
+func (dd *dynamicDetector) laterThan(bucket int, peer AlertsMessage) AlertsMessage {
+	skew := dd.clockSkewAt(peer.Now, peer.Received)
+	peerTimeouts := make(map[Alert]int64, len(peer.Alerts))
+	for _, ad := range peer.Alerts {
+		peerTimeouts[ad.Alert] = ad.Timeout + skew
+	}
+
+	dd.lock.RLock()
+	defer dd.lock.RUnlock()
+	later := AlertsMessage{Alerts: make([]AlertData, 0), Now: dd.clock.Now().Unix()}
+	for key, a := range dd.index.alerts {
+		timeout := dd.alerts[a]
+		if timeout <= later.Now || digestBucket(key) != bucket {
+			continue
+		}
+		if peerTimeout, ok := peerTimeouts[a]; ok && peerTimeout >= timeout {
+			continue
+		}
+		later.Alerts = append(later.Alerts, AlertData{Key: key, Alert: a, Timeout: timeout, ValidFrom: dd.validFrom[a]})
+	}
+	return later
+}
+
+// applies an alert pulled from a peer, counting it if it changed our state
+func (ae *antiEntropy) repair(c AlertChange) {
+	if ae.dd.applyPeerChange(c, sourceSync) {
+		ae.alertsRepairedCounter.Inc(worker.MetricLabels{"analytic": pgm})
+	}
+}
+
+// takes alerts pushed by a peer that found our copy missing them or with an
+// earlier timeout, /alerts/repair
+func (as *alertServer) handleRepair(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST alerts to repair", http.StatusMethodNotAllowed)
+		return
+	}
+	am := AlertsMessage{Received: as.dd.clock.Now().Unix()}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRepairSize)).Decode(&am)
+	if err != nil {
+		http.Error(w, "couldn't read alerts: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, c := range as.dd.localChanges(am) {
+		select {
+		case as.dd.antiEntropy.repairs <- c:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// returns the alerts from a peer as snapshot changes with their times moved
+// onto our clock, using the skew from when the message arrived rather than
+// when the changes are applied
+func (dd *dynamicDetector) localChanges(am AlertsMessage) []AlertChange {
+	skew := dd.clockSkewAt(am.Now, am.Received)
+	changes := make([]AlertChange, 0, len(am.Alerts))
+	for _, ad := range am.Alerts {
+		a := ad.Alert
+		c := AlertChange{Op: changeSnapshot, Key: ad.Key, Alert: &a, Timeout: ad.Timeout + skew}
+		if ad.ValidFrom != 0 {
+			c.ValidFrom = ad.ValidFrom + skew
+		}
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+func postPeerJSON(ctx context.Context, pc *peerClient, url string, v interface{}) error {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(j))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", jsonContentType)
+	resp, err := pc.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return errors.New("unexpected status " + resp.Status)
+	}
+	return nil
+}
+
+func getPeerJSON(ctx context.Context, pc *peerClient, url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := pc.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("unexpected status " + resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDigestMatchesForSameState(t *testing.T) {
+	clock := newFakeClock(time.Now())
+
+	var dd1, dd2 dynamicDetector
+	dd1.clock = clock
+	dd1.Init()
+	dd2.clock = clock
+	dd2.Init()
+	a := testSyncAlert()
+	a2 := a
+	a2.Indicator.Value = "a.tunnel.com"
+
+	dd1.AddAlert(a)
+	dd1.AddAlert(a2)
+	// alerts added in a different order
+	dd2.AddAlert(a2)
+	dd2.AddAlert(a)
+
+	d1 := dd1.digest()
+	d2 := dd2.digest()
+	for b := range d1.Buckets {
+		if d1.Buckets[b] != d2.Buckets[b] {
+			t.Error("digests of the same alert state should match, bucket ", b, " differs")
+		}
+	}
+
+	a3 := a
+	a3.Indicator.Value = "another.tunnel.com"
+	dd2.AddAlert(a3)
+	d2 = dd2.digest()
+	differ := 0
+	for b := range d1.Buckets {
+		if d1.Buckets[b] != d2.Buckets[b] {
+			differ++
+		}
+	}
+	if differ != 1 {
+		t.Error("one additional alert should change one digest bucket, changed ", differ)
+	}
+	dd1.cleanup()
+	dd2.cleanup()
+}
+
+func TestAntiEntropyRepairsMissingAlerts(t *testing.T) {
+	clock := newFakeClock(time.Now())
+
+	var peer, dd dynamicDetector
+	peer.clock = clock
+	peer.Init()
+	dd.clock = clock
+	dd.Init()
+	a := testSyncAlert()
+	a2 := a
+	a2.Indicator.Value = "a.tunnel.com"
+	peer.AddAlert(a)
+	peer.AddAlert(a2)
+	dd.AddAlert(a)
+
+	var as alertServer
+	as.dd = &peer
+	mux := http.NewServeMux()
+	mux.HandleFunc("/alerts", as.handle)
+	mux.HandleFunc("/alerts/digest", as.handleDigest)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	dd.antiEntropy.peerURL = server.URL
+	ch := make(chan AlertChange, 100)
+	err := dd.antiEntropy.reconcile(context.Background(), ch)
+	if err != nil {
+		t.Fatal("reconcile failed: ", err.Error())
+	}
+	close(ch)
+
+	repaired := 0
+	for c := range ch {
+		if dd.applyPeerChange(c, sourcePeer) {
+			repaired++
+		}
+	}
+	if repaired != 1 {
+		t.Error("only the missing alert should be repaired, repaired ", repaired)
+	}
+	if _, ok := dd.alerts[a2]; !ok {
+		t.Error("alert missing from replica should be pulled from peer")
+	}
+	dd.cleanup()
+	peer.cleanup()
+}
+
+func TestAntiEntropyConvergesTwoReplicas(t *testing.T) {
+	clock := newFakeClock(time.Now())
+
+	var dd1, dd2 dynamicDetector
+	dd1.clock = clock
+	dd1.Init()
+	dd2.clock = clock
+	dd2.Init()
+	a := testSyncAlert()
+	// only on the second replica
+	a2 := a
+	a2.Indicator.Value = "a.tunnel.com"
+	dd1.AddAlert(a)
+	dd2.AddAlert(a2)
+	// the first replica has the later timeout
+	clock.Advance(30 * time.Second)
+	dd2.AddAlert(a)
+	clock.Advance(10 * time.Second)
+	dd1.AddAlert(a)
+
+	var as alertServer
+	as.dd = &dd2
+	mux := http.NewServeMux()
+	mux.HandleFunc("/alerts", as.handle)
+	mux.HandleFunc("/alerts/digest", as.handleDigest)
+	mux.HandleFunc("/alerts/repair", as.handleRepair)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// only the first replica reconciles
+	dd1.antiEntropy.peerURL = server.URL
+	err := dd1.antiEntropy.reconcile(context.Background(), dd1.antiEntropy.repairs)
+	if err != nil {
+		t.Fatal("reconcile failed: ", err.Error())
+	}
+	for _, dd := range []*dynamicDetector{&dd1, &dd2} {
+		for len(dd.antiEntropy.repairs) > 0 {
+			dd.antiEntropy.repair(<-dd.antiEntropy.repairs)
+		}
+	}
+
+	if dd1.alerts[a2] != dd2.alerts[a2] || dd2.alerts[a] != dd1.alerts[a] {
+		t.Error("replicas should have the same alerts and timeouts after reconciling")
+	}
+	d1 := dd1.digest()
+	d2 := dd2.digest()
+	for b := range d1.Buckets {
+		if d1.Buckets[b] != d2.Buckets[b] {
+			t.Error("digests should match after reconciling, bucket ", b, " differs")
+		}
+	}
+	dd1.cleanup()
+	dd2.cleanup()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testAuditSink struct {
+	lock    sync.Mutex
+	records []AuditRecord
+	keys    []string
+}
+
+func (s *testAuditSink) write(change string, record []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var r AuditRecord
+	err := json.Unmarshal(record, &r)
+	s.records = append(s.records, r)
+	s.keys = append(s.keys, change)
+	return err
+}
+
+func (s *testAuditSink) close() error {
+	return nil
+}
+
+func TestAuditLogRecordsLifecycle(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+	var sink testAuditSink
+	dd.audits.startWith(&sink)
+
+	now := clock.Now().Unix()
+	a := testSyncAlert()
+	b := testSyncAlert()
+	b.Device = "b-dev"
+	dd.AddAlert(a)
+	dd.applyPeerChange(AlertChange{Op: changeAdd, Alert: &b, Timeout: now + 30, Now: now}, sourcePeer)
+	clock.Advance(60 * time.Second)
+	dd.applyPeerChange(AlertChange{Op: changeExtend, Alert: &a, Timeout: now + 120, Now: now + 60}, sourceSync)
+	dd.RevokeAlert(b, sourcePeer)
+	clock.Advance(200 * time.Second)
+	dd.TimeoutAlerts()
+	dd.audits.stop()
+
+	expected := []AuditRecord{
+		{Change: alertAdded, Source: sourceAMQP, NewExpiry: now + 60},
+		{Change: alertAdded, Source: sourcePeer, NewExpiry: now + 30},
+		{Change: alertExtended, Source: sourceSync, OldExpiry: now + 60, NewExpiry: now + 120},
+		{Change: alertRevoked, Source: sourcePeer, OldExpiry: now + 30},
+		{Change: alertExpired, Source: sourceLocal, OldExpiry: now + 120},
+	}
+	if len(sink.records) != len(expected) {
+		t.Fatal("expected ", len(expected), " audit records, got ", sink.records)
+	}
+	for i, e := range expected {
+		r := sink.records[i]
+		if r.Change != e.Change || r.Source != e.Source || r.OldExpiry != e.OldExpiry || r.NewExpiry != e.NewExpiry {
+			t.Error("audit record ", i, " should be ", e, " got ", r)
+		}
+		if sink.keys[i] != e.Change {
+			t.Error("records should be routed by the change")
+		}
+		if r.IOC == "" || r.Replica == "" || r.Key != r.Alert.Key() {
+			t.Error("audit record should identify the alert, IOC and replica: ", r)
+		}
+	}
+	dd.cleanup()
+}
+
+func TestAuditLogRecordsRejectedAlerts(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+	dd.limits.maxAlerts = 1
+	dd.limits.eviction = evictRejectNew
+	var sink testAuditSink
+	dd.audits.startWith(&sink)
+
+	a := testSyncAlert()
+	b := testSyncAlert()
+	b.Device = "b-dev"
+	dd.AddAlert(a)
+	dd.AddAlert(b)
+	dd.audits.stop()
+
+	if len(sink.records) != 2 || sink.records[1].Change != alertRejected || sink.records[1].Alert != b {
+		t.Error("alert rejected by a full alert store should be audited, got ", sink.records)
+	}
+	dd.cleanup()
+}
+
+// blocks writes until released
+type blockedAuditSink struct {
+	testAuditSink
+	release chan bool
+}
+
+func (s *blockedAuditSink) write(change string, record []byte) error {
+	<-s.release
+	return s.testAuditSink.write(change, record)
+}
+
+func TestAuditLogGapRecordBeforeNextRecord(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+	dd.audits.records = make(chan AuditRecord, 2)
+
+	a := testSyncAlert()
+	for _, change := range []string{alertAdded, alertExtended, alertExtended, alertExtended} {
+		dd.audits.send(AuditRecord{Change: change, Alert: a})
+	}
+	for i := 0; i < 2; i++ {
+		<-dd.audits.records
+	}
+	dd.audits.send(AuditRecord{Change: alertRevoked, Alert: a})
+	if r := <-dd.audits.records; r.Change != auditGap || r.Dropped != 2 || r.Replica != dd.hostname {
+		t.Error("gap record should be queued in place of the dropped records, got ", r)
+	}
+	if r := <-dd.audits.records; r.Change != alertRevoked {
+		t.Error("record should follow the gap record, got ", r)
+	}
+	if dd.audits.dropped != 0 {
+		t.Error("dropped count should be reset once the gap record is queued")
+	}
+	dd.audits.records = nil
+	dd.cleanup()
+}
+
+func TestAuditLogDoesNotBlockWhenFull(t *testing.T) {
+	var dd dynamicDetector
+	dd.Init()
+	dd.audits.buffer = 1
+	sink := blockedAuditSink{release: make(chan bool)}
+	dd.audits.startWith(&sink)
+
+	added := make(chan bool)
+	go func() {
+		for i := 0; i < 5; i++ {
+			a := testSyncAlert()
+			a.Device = "dev-" + string('a'+rune(i))
+			dd.AddAlert(a)
+		}
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(5 * time.Second):
+		t.Fatal("adding alerts should not block on a full audit log")
+	}
+	close(sink.release)
+	dd.audits.stop()
+
+	written, dropped := 0, 0
+	for _, r := range sink.records {
+		if r.Change == auditGap {
+			dropped += r.Dropped
+			continue
+		}
+		written++
+	}
+	if written == 0 || written >= 5 {
+		t.Error("records that did not fit in the buffer should be dropped, got ", written)
+	}
+	if written+dropped != 5 || sink.records[len(sink.records)-1].Change != auditGap {
+		t.Error("dropped records should be counted in a gap record, got ", sink.records)
+	}
+	dd.cleanup()
+}
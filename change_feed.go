@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/google/uuid"
+	"sync"
+)
+
+const (
+	// alert state in a snapshot sent before live changes
+	changeSnapshot = "snapshot"
+	// end of the snapshot, live changes follow
+	changeSynced = "synced"
+	changeAdd    = "add"
+	changeExtend = "extend"
+	changeExpire = "expire"
+	changeRevoke = "revoke"
+	// removed to make room in a full alert store, ignored by peers as their
+	// stores have their own limits
+	changeEvict     = "evict"
+	changeHeartbeat = "heartbeat"
+
+	// number of recent changes kept so a client can resume a stream without
+	// a new snapshot
+	feedHistorySize = 10000
+	// changes buffered for each subscriber before it is dropped as too slow
+	feedSubscriberBuffer = 1000
+)
+
+// a change to the alert state, streamed to other dynamic detectors
+type AlertChange struct {
+	Feed    string `json:"feed,omitempty"`
+	Seq     uint64 `json:"seq"`
+	Op      string `json:"op"`
+	Key     string `json:"key,omitempty"`
+	Alert   *Alert `json:"alert,omitempty"`
+	Timeout int64  `json:"timeout,omitempty"`
+	// time the alert became active, on the sender's clock
+	ValidFrom int64 `json:"valid_from,omitempty"`
+	// sender's clock (unix seconds), used to correct for clock skew. Zero if
+	// the times have already been moved onto our clock
+	Now int64 `json:"now"`
+}
+
+// sequenced feed of alert state changes. Changes are published whilst the
+// detector state lock is held, so taking the state read lock whilst
+// subscribing gives a snapshot consistent with the changes that follow
+type changeFeed struct {
+	lock sync.Mutex
+	// identifies this feed, sequence numbers are only meaningful within it
+	id          string
+	clock       Clock
+	seq         uint64
+	history     []AlertChange
+	subscribers map[chan AlertChange]bool
+}
+
+func (f *changeFeed) init(clock Clock) {
+	f.clock = clock
+	f.id = uuid.New().String()
+	f.history = make([]AlertChange, 0, 2*feedHistorySize)
+	f.subscribers = make(map[chan AlertChange]bool)
+}
+
+func (f *changeFeed) publish(op string, a Alert, validFrom, timeout int64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.seq++
+	c := AlertChange{Feed: f.id, Seq: f.seq, Op: op, Key: a.Key(), Alert: &a, Timeout: timeout, ValidFrom: validFrom, Now: f.clock.Now().Unix()}
+	// history grows to twice its size before old changes are dropped, so
+	// they are not copied on every change
+	if len(f.history) == 2*feedHistorySize {
+		f.history = append(make([]AlertChange, 0, 2*feedHistorySize), f.history[feedHistorySize:]...)
+	}
+	f.history = append(f.history, c)
+
+	for ch := range f.subscribers {
+		select {
+		case ch <- c:
+		default:
+			// subscriber is not keeping up, drop it so it reconnects and resumes
+			delete(f.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribes to changes after seq on the given feed. Returns the changes
+// since then, or false if they are no longer available and the subscriber
+// needs a snapshot. The current sequence number is returned to mark the
+// end of a snapshot
+func (f *changeFeed) subscribe(feed string, since uint64) (chan AlertChange, []AlertChange, uint64, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	ch := make(chan AlertChange, feedSubscriberBuffer)
+	f.subscribers[ch] = true
+
+	if feed != f.id || since > f.seq {
+		return ch, nil, f.seq, false
+	}
+	if since == f.seq {
+		return ch, []AlertChange{}, f.seq, true
+	}
+	if len(f.history) == 0 || f.history[0].Seq > since+1 {
+		return ch, nil, f.seq, false
+	}
+	missed := f.history[since+1-f.history[0].Seq:]
+	backlog := make([]AlertChange, len(missed))
+	copy(backlog, missed)
+	return ch, backlog, f.seq, true
+}
+
+func (f *changeFeed) unsubscribe(ch chan AlertChange) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.subscribers[ch] {
+		delete(f.subscribers, ch)
+		close(ch)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// source of time for the detector, lets tests and replays control time
+// rather than waiting on the wall clock
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+	Sleep(d time.Duration)
+	// calls f in its own goroutine once d has passed
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// timer from AfterFunc, Stop and Reset return true if the timer was still
+// waiting to fire
+type Timer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// the wall clock
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// a clock which only moves when told to. Timers and tickers fire when the
+// clock is moved past their deadline
+type fakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+type fakeWaiter struct {
+	clock    *fakeClock
+	deadline time.Time
+	// zero for a timer
+	period time.Duration
+	ch     chan time.Time
+	// called instead of sending on ch, for AfterFunc
+	f       func()
+	stopped bool
+	fired   bool
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.wait(d, 0).ch
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	return c.wait(d, d)
+}
+
+// returns once the clock has been moved on by d
+func (c *fakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	w := &fakeWaiter{clock: c, deadline: c.now.Add(d), f: f}
+	c.waiters = append(c.waiters, w)
+	c.fire()
+	return fakeTimer{w}
+}
+
+func (c *fakeClock) wait(d, period time.Duration) *fakeWaiter {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// buffered like the time package, so firing never blocks the clock
+	w := &fakeWaiter{clock: c, deadline: c.now.Add(d), period: period, ch: make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, w)
+	c.fire()
+	return w
+}
+
+// moves the clock forward
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	c.fire()
+}
+
+// sets the clock, it is never moved backwards
+func (c *fakeClock) Set(t time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if t.After(c.now) {
+		c.now = t
+		c.fire()
+	}
+}
+
+// returns the number of timers and tickers waiting to fire, lets tests wait
+// for a goroutine to start waiting before moving the clock
+func (c *fakeClock) Waiters() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := 0
+	for _, w := range c.waiters {
+		if !w.stopped {
+			n++
+		}
+	}
+	return n
+}
+
+// fires waiters that are due, the lock must be held
+func (c *fakeClock) fire() {
+	waiting := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.stopped {
+			continue
+		}
+		if !w.deadline.After(c.now) {
+			if w.f != nil {
+				go w.f()
+			} else {
+				select {
+				case w.ch <- c.now:
+				default:
+					// like time.Ticker, ticks are dropped for slow receivers
+				}
+			}
+			if w.period == 0 {
+				w.fired = true
+				continue
+			}
+			for !w.deadline.After(c.now) {
+				w.deadline = w.deadline.Add(w.period)
+			}
+		}
+		waiting = append(waiting, w)
+	}
+	c.waiters = waiting
+}
+
+func (w *fakeWaiter) C() <-chan time.Time {
+	return w.ch
+}
+
+func (w *fakeWaiter) Stop() {
+	w.clock.lock.Lock()
+	defer w.clock.lock.Unlock()
+	w.stopped = true
+}
+
+// timer from fakeClock.AfterFunc
+type fakeTimer struct {
+	w *fakeWaiter
+}
+
+func (t fakeTimer) Stop() bool {
+	t.w.clock.lock.Lock()
+	defer t.w.clock.lock.Unlock()
+	waiting := !t.w.stopped && !t.w.fired
+	t.w.stopped = true
+	return waiting
+}
+
+func (t fakeTimer) Reset(d time.Duration) bool {
+	c := t.w.clock
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	waiting := !t.w.stopped && !t.w.fired
+	if !waiting {
+		// fired and stopped timers are dropped from the waiters when the
+		// clock next fires, a stopped one may not have been yet
+		if !t.w.fired {
+			for i, w := range c.waiters {
+				if w == t.w {
+					c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+					break
+				}
+			}
+		}
+		c.waiters = append(c.waiters, t.w)
+	}
+	t.w.stopped = false
+	t.w.fired = false
+	t.w.deadline = c.now.Add(d)
+	c.fire()
+	return waiting
+}
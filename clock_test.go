@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFakeClockFiresTimers(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	after := clock.After(5 * time.Second)
+	ticker := clock.NewTicker(2 * time.Second)
+
+	clock.Advance(time.Second)
+	select {
+	case <-after:
+		t.Error("timer should not fire before its deadline")
+	case <-ticker.C():
+		t.Error("ticker should not fire before its period")
+	default:
+	}
+
+	clock.Advance(4 * time.Second)
+	select {
+	case <-after:
+	default:
+		t.Error("timer should fire once the clock passes its deadline")
+	}
+	select {
+	case <-ticker.C():
+	default:
+		t.Error("ticker should fire once the clock passes its period")
+	}
+
+	ticker.Stop()
+	clock.Advance(10 * time.Second)
+	select {
+	case <-ticker.C():
+		t.Error("stopped ticker should not fire")
+	default:
+	}
+	if clock.Waiters() != 0 {
+		t.Error("fired timers and stopped tickers should not be waiting, got ", clock.Waiters())
+	}
+
+	now := clock.Now()
+	clock.Set(now.Add(-time.Minute))
+	if !clock.Now().Equal(now) {
+		t.Error("clock should not be moved backwards")
+	}
+}
+
+func TestFakeClockAfterFunc(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	fired := make(chan bool, 1)
+	timer := clock.AfterFunc(5*time.Second, func() { fired <- true })
+
+	clock.Advance(4 * time.Second)
+	if !timer.Reset(5 * time.Second) {
+		t.Error("reset of a waiting timer should return true")
+	}
+	clock.Advance(4 * time.Second)
+	select {
+	case <-fired:
+		t.Error("reset timer should not fire before its new deadline")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	select {
+	case <-fired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timer should fire once the clock passes its deadline")
+	}
+
+	if timer.Stop() {
+		t.Error("stopping a fired timer should return false")
+	}
+	timer.Reset(time.Second)
+	if !timer.Stop() {
+		t.Error("stopping a waiting timer should return true")
+	}
+	clock.Advance(time.Minute)
+	select {
+	case <-fired:
+		t.Error("stopped timer should not fire")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if clock.Waiters() != 0 {
+		t.Error("fired and stopped timers should not be waiting, got ", clock.Waiters())
+	}
+}
+
+func TestStateSavedOnClockTicks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dynamic-detector")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clock := newFakeClock(time.Now())
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+	dd.stateFile = filepath.Join(dir, "state.json")
+	dd.AddAlert(testSyncAlert())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		dd.saveStatePeriodically(ctx)
+		close(done)
+	}()
+
+	// wait for the save ticker, the expiry timer is also waiting
+	for clock.Waiters() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := os.Stat(dd.stateFile); err == nil {
+		t.Error("state shouldn't be saved before the interval")
+	}
+	clock.Advance(dd.stateSaveInterval)
+	for i := 0; i < 1000; i++ {
+		if _, err := os.Stat(dd.stateFile); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	am, err := loadStateFile(dd.stateFile)
+	if err != nil {
+		t.Fatal("state should be saved when the clock passes the interval: ", err.Error())
+	}
+	if len(am.Alerts) != 1 {
+		t.Error("saved state should contain the alert, got ", len(am.Alerts))
+	}
+	cancel()
+	<-done
+	dd.cleanup()
+}
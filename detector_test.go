@@ -119,6 +119,41 @@ func TestIndicatorAppendedToEvent(t *testing.T) {
 	dd.cleanup()
 }
 
+func TestNetworkScopedAlertTagsOnlyItsNetwork(t *testing.T) {
+	var dd dynamicDetector
+	dd.Init()
+
+	a := Alert{
+		Device:  "theatregoing-mac",
+		Network: "vpn",
+		Type:    "dns",
+		Indicator: dt.Indicator{
+			Type:        "hostname",
+			Value:       "blah.com",
+			Category:    "covert.dns-tunnel",
+			Probability: 0.9,
+			Id:          "b1769a6b-80c0-40e5-9287-a9a5d4262741",
+		},
+		TTL: 10,
+	}
+	dd.AddAlert(a)
+
+	event := loadEventFromFile("test_data/single-dns-tunnel-event.json", t)
+	dd.handleEvent(event)
+	if event.Indicators == nil || len(*event.Indicators) != 1 {
+		t.Error("event from the alert's network should be tagged")
+	}
+
+	// the same event seen on another network
+	event = loadEventFromFile("test_data/single-dns-tunnel-event.json", t)
+	event.Network = "office"
+	dd.handleEvent(event)
+	if event.Indicators != nil && len(*event.Indicators) != 0 {
+		t.Error("event from another network should not be tagged")
+	}
+	dd.cleanup()
+}
+
 func TestHandleFormatsEventCorrectly(t *testing.T) {
 	var dd dynamicDetector
 	dd.Init()
@@ -187,11 +222,10 @@ func TestHandleFormatsEventCorrectly(t *testing.T) {
 }
 
 func TestHandleTriggersTimeout(t *testing.T) {
+	clock := newFakeClock(time.Now())
 	var dd dynamicDetector
+	dd.clock = clock
 	dd.Init()
-	timeoutChan := make(chan time.Time, 1)
-	// replace timeout with channel for test purposes
-	dd.timeout = timeoutChan
 
 	if len(dd.alerts) != 0 {
 		t.Error("Alerts should be empty after init")
@@ -218,11 +252,6 @@ func TestHandleTriggersTimeout(t *testing.T) {
 			IP: destIpVal,
 		},
 	}
-	// mock out the now function
-	now := time.Now()
-	Now = func() time.Time {
-		return now
-	}
 	dd.AddAlert(a)
 
 	eventBytes := loadEventAsUint8sFromFile("test_data/single-dns-tunnel-event.json", t)
@@ -255,13 +284,8 @@ func TestHandleTriggersTimeout(t *testing.T) {
 		t.Error("Event should have had indicator added whilst alert active")
 	}
 
-	// change now time to be past TTL
-	Now = func() time.Time {
-		return now.Add(time.Second * 15)
-	}
-
-	// trigger the timeout timer (dont care what the value is)
-	timeoutChan <- now
+	// move the clock past the TTL, this also fires the timeout timer
+	clock.Advance(time.Second * 15)
 
 	dd.Handle(*eventBytes, nil)
 
@@ -9,45 +9,143 @@ import (
 	"github.com/trustnetworks/analytics-common/worker"
 	detLib "github.com/trustnetworks/detectorlib"
 	ind "github.com/trustnetworks/indicators"
-	"io/ioutil"
-	"net/http"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 )
 
 const (
 	// Program name, used for log entries.
 	pgm = "dynamic-detector"
-)
 
-var (
-	Now = time.Now
+	// interval state changes are applied at when there are no events
+	stateUpdateInterval = time.Second
 )
 
 type dynamicDetector struct {
+	// held whilst changing the alert state so it can be read by the alert
+	// server, the state is only changed by the event handling goroutine
+	lock sync.RWMutex
+	// held whilst handling an event or applying state changes when there are
+	// no events, so only one goroutine changes the state at a time
+	handling sync.Mutex
+	// the wall clock unless set before Init
+	clock Clock
+
 	alerts        map[Alert]int64
 	detectorLib   detLib.Detector
 	alertToIOCMap map[Alert]*ind.IndicatorNode
+	// alert each loaded IOC was created for, by IOC ID
+	iocAlerts map[string]Alert
+	// stored alerts by key
+	index alertIndex
+	// time (unix seconds) each alert became active
+	validFrom map[Alert]int64
+	expiry    expiryConfig
+	// values the loaded IOCs match on, nil if the prefilter is disabled
+	prefilter *iocPrefilter
 
 	timeout <-chan time.Time
 
 	alertsCh    <-chan Alert
 	alertErrors <-chan error
 
+	// changes to the alert state, streamed to other dynamic detectors
+	changes changeFeed
+	// name of this replica
+	hostname string
+	// base URL of the alert server of other dynamic detectors
+	peerURL     string
+	peerClient  peerClient
+	initialLoad initialLoadConfig
+	// file the alert state is saved to, empty if not saved
+	stateFile         string
+	stateSaveInterval time.Duration
+	// changes streamed from another dynamic detector
+	peerChanges <-chan AlertChange
+	// alerts pulled from another dynamic detector by anti-entropy
+	repairs     <-chan AlertChange
+	antiEntropy antiEntropy
+
+	status detectorStatus
+
+	limits alertLimits
+	// stored alerts in the order the limits evict them
+	evictionOrder evictionOrder
+	ttlPolicy     ttlPolicy
+	// recently seen events, tagged retroactively when a new alert loads
+	retro retroBuffer
+
+	// clock skew (seconds) with a peer above which a warning is logged
+	clockSkewWarning int64
+
+	metrics alertMetrics
+	audits  auditLog
+	// intervals alerts that are no longer stored were active for
+	history alertHistory
+	latency eventLatency
+
 	indicatorsAddedCounter *worker.Counter
 	alertDBSizeGauge       *worker.Gauge
+	alertsEvictedCounter   *worker.Counter
 }
 
 func (dd *dynamicDetector) Init() {
 	dd.alerts = make(map[Alert]int64)
 	dd.alertToIOCMap = make(map[Alert]*ind.IndicatorNode)
+	dd.iocAlerts = make(map[string]Alert)
+	dd.index.init()
+	dd.validFrom = make(map[Alert]int64)
+	dd.expiry.init()
+	// on unless LOOKUP_PREFILTER=false. IOCs the prefilter can not index by
+	// required values (a NOT at the root, CIDR or numeric patterns) disable
+	// it so every event is still looked up
+	if utils.Getenv("LOOKUP_PREFILTER", "true") != "false" {
+		dd.prefilter = newIOCPrefilter()
+	}
 	dd.detectorLib = detLib.GetDetector()
-	dd.timeout = time.After(5 * time.Second)
+	if dd.clock == nil {
+		dd.clock = realClock{}
+	}
+	dd.timeout = dd.clock.After(5 * time.Second)
+	dd.status.init(dd.clock)
+	dd.changes.init(dd.clock)
+	dd.hostname = localHostname()
+	dd.peerClient.clock = dd.clock
+	dd.peerClient.init()
+	dd.peerURL = utils.Getenv("PEER_URL", dd.peerClient.defaultPeerURL())
+	dd.initialLoad.init(dd.peerURL)
+	for _, url := range append([]string{dd.peerURL}, dd.initialLoad.peers...) {
+		if err := dd.peerClient.checkURL(url); err != nil {
+			log.Fatal("Refusing to start: ", err.Error())
+		}
+	}
+	dd.stateFile = utils.Getenv("STATE_FILE", "")
+	saveInterval, err := strconv.Atoi(utils.Getenv("STATE_SAVE_INTERVAL", "60"))
+	if err != nil || saveInterval <= 0 {
+		log.Error("Invalid STATE_SAVE_INTERVAL, using 60 seconds")
+		saveInterval = 60
+	}
+	dd.stateSaveInterval = time.Duration(saveInterval) * time.Second
+	dd.antiEntropy.init(dd)
+	dd.limits.init()
+	dd.evictionOrder.init(&dd.limits)
+	dd.ttlPolicy.init()
+	dd.retro.init()
+	dd.audits.init(dd.clock, dd.hostname)
+	dd.history.init()
+	skew, err := strconv.ParseInt(utils.Getenv("PEER_CLOCK_SKEW_WARNING", "5"), 10, 64)
+	if err != nil {
+		log.Error("Invalid PEER_CLOCK_SKEW_WARNING, using 5 seconds")
+		skew = 5
+	}
+	dd.clockSkewWarning = skew
 	dd.indicatorsAddedCounter = worker.CreateCounter(
 		worker.CounterOpts{
 			Name: "indicators_added_to_events",
 			Help: "number of indicators added to events",
-		}, []string{"analytic", "type"},
+		}, []string{"analytic", "type", "category"},
 	)
 	dd.alertDBSizeGauge = worker.CreateGauge(
 		worker.GaugeOpts{
@@ -56,47 +154,127 @@ func (dd *dynamicDetector) Init() {
 		}, []string{"analytic"},
 	)
 	dd.alertDBSizeGauge.Set(0, worker.MetricLabels{"analytic": pgm})
+	dd.metrics.init()
+	dd.latency.init()
+	dd.alertsEvictedCounter = worker.CreateCounter(
+		worker.CounterOpts{
+			Name: "alerts_evicted",
+			Help: "number of alerts evicted or rejected because the alert store is full",
+		}, []string{"analytic", "alert_type", "policy"},
+	)
 }
 
+// adds an alert received from upstream. The TTL policy is applied first, the
+// stored alert carries the effective TTL
 func (dd *dynamicDetector) AddAlert(a Alert) {
-	if a.TTL > 0 {
-		dd.alerts[a] = Now().Unix() + a.TTL
-		_, ok := dd.alertToIOCMap[a]
-		if !ok {
-			log.Info("alert not seen before, create new iocl")
-			ioc := convertAlertToIOC(a)
-			dd.alertToIOCMap[a] = ioc
-			dd.detectorLib.LoadNode(ioc)
+	dd.addAlert(a, sourceAMQP)
+}
+
+func (dd *dynamicDetector) addAlert(a Alert, source string) {
+	dd.lock.Lock()
+	defer dd.lock.Unlock()
+	a, ok := dd.ttlPolicy.apply(a)
+	if ok {
+		now := dd.clock.Now().Unix()
+		_, existed := dd.alertToIOCMap[a]
+		dd.storeAlert(a, now, now+a.TTL, source)
+		if _, stored := dd.alertToIOCMap[a]; stored && !existed {
+			dd.retroMatch(a)
 		}
 	}
 	dd.alertDBSizeGauge.Set(float64(len(dd.alerts)), worker.MetricLabels{"analytic": pgm})
 }
 
 // same functionality as add alert except the timeout is already specified so do not
-// work out the TTL
+// work out the TTL. The TTL policy is not applied, the alert was stored with
+// its effective TTL by the replica that received it, and as the TTL is part of
+// the alert's key changing it here would make replicas with different
+// policies hold different alerts for the same upstream alert
 func (dd *dynamicDetector) AddExistingAlert(a Alert, timeout int64) {
-	if timeout > Now().Unix() {
-		dd.alerts[a] = timeout
-		_, ok := dd.alertToIOCMap[a]
-		if !ok {
-			log.Info("alert not seen before, create new iocl")
-			ioc := convertAlertToIOC(a)
-			dd.alertToIOCMap[a] = ioc
-			dd.detectorLib.LoadNode(ioc)
-		}
+	dd.AddExistingAlertFrom(a, 0, timeout, sourcePeer)
+}
+
+// adds an alert with its validity window, a zero validFrom means it became
+// active now. The timeout is limited to what the alert could have if it was
+// received now, so a peer or the state file can not load an alert that
+// outlives its TTL
+func (dd *dynamicDetector) AddExistingAlertFrom(a Alert, validFrom, timeout int64, source string) {
+	dd.lock.Lock()
+	defer dd.lock.Unlock()
+	if validFrom == 0 {
+		validFrom = dd.clock.Now().Unix()
+	}
+	if max := dd.maxTimeout(a); timeout > max {
+		log.Debug("limiting timeout of ", a.Type, " alert for ", a.Indicator.Value, " from ", source, " to its TTL")
+		timeout = max
+	}
+	if timeout > dd.expiryNow() {
+		dd.storeAlert(a, validFrom, timeout, source)
 	}
 	dd.alertDBSizeGauge.Set(float64(len(dd.alerts)), worker.MetricLabels{"analytic": pgm})
 }
 
+// returns the latest timeout an alert can have, its TTL, or the TTL policy
+// max if that is lower, from now
+func (dd *dynamicDetector) maxTimeout(a Alert) int64 {
+	ttl := a.TTL
+	if max := dd.ttlPolicy.ruleFor(a).Max; max > 0 && max < ttl {
+		ttl = max
+	}
+	return dd.clock.Now().Unix() + ttl
+}
+
+// stores the alert with its validity window, creating and loading an IOC for
+// it if it has not been seen before and there is room in the alert store.
+// source is where the alert came from, for the audit log
+func (dd *dynamicDetector) storeAlert(a Alert, validFrom, timeout int64, source string) {
+	_, ok := dd.alertToIOCMap[a]
+	if !ok {
+		if !dd.makeRoom(a, timeout, source) {
+			return
+		}
+		log.Info("alert not seen before, create new iocl")
+		ioc := convertAlertToIOC(a)
+		if ioc != nil {
+			tagIOC(ioc)
+			dd.iocAlerts[ioc.ID] = a
+		}
+		dd.alertToIOCMap[a] = ioc
+		dd.detectorLib.LoadNode(ioc)
+		if dd.prefilter != nil {
+			dd.prefilter.add(ioc)
+		}
+		dd.alerts[a] = timeout
+		dd.validFrom[a] = validFrom
+		dd.index.add(a.Key(), a)
+		dd.evictionOrder.set(a, timeout)
+		dd.metrics.stored(a, alertAdded, timeout-dd.clock.Now().Unix())
+		dd.audit(a, alertAdded, source, 0, timeout)
+		dd.changes.publish(changeAdd, a, validFrom, timeout)
+		return
+	}
+	if validFrom < dd.validFrom[a] {
+		dd.validFrom[a] = validFrom
+	}
+	if dd.alerts[a] != timeout {
+		dd.audit(a, alertExtended, source, dd.alerts[a], timeout)
+		dd.alerts[a] = timeout
+		dd.evictionOrder.set(a, timeout)
+		dd.metrics.stored(a, alertExtended, timeout-dd.clock.Now().Unix())
+		dd.changes.publish(changeExtend, a, dd.validFrom[a], timeout)
+	}
+}
+
 func (dd *dynamicDetector) TimeoutAlerts() {
+	dd.lock.Lock()
+	defer dd.lock.Unlock()
 	before := len(dd.alerts)
-	now := Now().Unix()
+	now := dd.expiryNow()
 	for a, exp := range dd.alerts {
 		if exp < now {
-			delete(dd.alerts, a)
-			ioc, _ := dd.alertToIOCMap[a]
-			dd.removeIOC(ioc)
-			delete(dd.alertToIOCMap, a)
+			validFrom := dd.validFrom[a]
+			dd.removeAlert(a, alertExpired, sourceLocal)
+			dd.changes.publish(changeExpire, a, validFrom, exp)
 		}
 	}
 	after := len(dd.alerts)
@@ -106,79 +284,224 @@ func (dd *dynamicDetector) TimeoutAlerts() {
 	dd.alertDBSizeGauge.Set(float64(len(dd.alerts)), worker.MetricLabels{"analytic": pgm})
 }
 
+// removes an alert from the state and its IOC from the detector, change is
+// why it was removed and source where that came from
+func (dd *dynamicDetector) removeAlert(a Alert, change, source string) {
+	if timeout, ok := dd.alerts[a]; ok {
+		dd.metrics.removed(a, change)
+		dd.audit(a, change, source, timeout, 0)
+		dd.endInterval(a, change)
+		dd.index.remove(a.Key())
+		dd.evictionOrder.remove(a)
+	}
+	delete(dd.alerts, a)
+	delete(dd.validFrom, a)
+	ioc, _ := dd.alertToIOCMap[a]
+	if ioc != nil {
+		delete(dd.iocAlerts, ioc.ID)
+	}
+	dd.removeIOC(ioc)
+	delete(dd.alertToIOCMap, a)
+}
+
 func (dd *dynamicDetector) removeIOC(ioc *ind.IndicatorNode) {
 	dd.detectorLib.RemoveNode(ioc)
+	if dd.prefilter != nil {
+		dd.prefilter.remove(ioc)
+	}
+}
+
+// the parts of the detector state events are looked up against
+type detectorView struct {
+	detector  *detLib.Detector
+	alerts    map[Alert]int64
+	validFrom map[Alert]int64
+	iocAlerts map[string]Alert
+	eventTime bool
+	prefilter *iocPrefilter
+}
+
+// returns a view of the live detector state, only used by the event handling
+// goroutine or with the state lock held
+func (dd *dynamicDetector) liveView() *detectorView {
+	return &detectorView{
+		detector:  &dd.detectorLib,
+		alerts:    dd.alerts,
+		validFrom: dd.validFrom,
+		iocAlerts: dd.iocAlerts,
+		eventTime: dd.expiry.eventTime(),
+		prefilter: dd.prefilter,
+	}
+}
+
+// tags the root of an IOC with its ID so a hit identifies the IOC, and so the
+// alert, that matched. The detector library returns the root's indicator,
+// alerts for different devices or networks can share the same indicator
+func tagIOC(ioc *ind.IndicatorNode) {
+	i := *ioc.Indicator
+	i.Id = ioc.ID
+	ioc.Indicator = &i
+}
+
+// looks up the alerts whose IOCs an event matches. In event-time mode only
+// alerts active when the event happened are matched
+func (v *detectorView) lookupAlerts(event *dt.Event, now int64) []Alert {
+	hits := v.detector.Lookup(event)
+	if len(hits) == 0 {
+		return nil
+	}
+	t := now
+	if v.eventTime {
+		if et, ok := eventTime(event); ok {
+			t = et
+		}
+	}
+	alerts := make([]Alert, 0, len(hits))
+	for _, hit := range hits {
+		a, ok := v.iocAlerts[hit.Id]
+		if !ok {
+			continue
+		}
+		if v.eventTime && !v.activeAt(a, t) {
+			continue
+		}
+		alerts = append(alerts, a)
+	}
+	return alerts
+}
+
+// looks up the indicators for the dynamic IOCs an event matches. In
+// event-time mode only alerts active when the event happened are matched
+func (v *detectorView) lookupIndicators(event *dt.Event, now int64) []*dt.Indicator {
+	return alertIndicators(v.lookupAlerts(event, now))
 }
 
-func (dd *dynamicDetector) handleEvent(event *dt.Event) {
-	indicators := dd.detectorLib.Lookup(event)
+// returns a copy of the indicator of each alert
+func alertIndicators(alerts []Alert) []*dt.Indicator {
+	indicators := make([]*dt.Indicator, 0, len(alerts))
+	for _, a := range alerts {
+		i := a.Indicator
+		// Set indicator probability to 1.0 (if not set)
+		if i.Probability == 0 {
+			i.Probability = 1.0
+		}
+		indicators = append(indicators, &i)
+	}
+	return indicators
+}
+
+func (dd *dynamicDetector) lookupIndicators(event *dt.Event) []*dt.Indicator {
+	return dd.liveView().lookupIndicators(event, dd.clock.Now().Unix())
+}
+
+func (dd *dynamicDetector) handleEvent(event *dt.Event) []Alert {
+	return dd.handleEventWith(dd.liveView(), event)
+}
+
+// adds the indicators for the IOCs the event matches in the view, returns
+// the alerts they were created for
+func (dd *dynamicDetector) handleEventWith(v *detectorView, event *dt.Event) []Alert {
+	dd.observeEvent(event)
+	alerts := v.lookupAlerts(event, dd.clock.Now().Unix())
+	indicators := alertIndicators(alerts)
 	if len(indicators) > 0 {
 		// metricate the hits
-		go func() {
-			for _, itor := range indicators {
-				dd.indicatorsAddedCounter.Inc(worker.MetricLabels{"analytic": pgm, "type": itor.Type})
-			}
-		}()
+		for _, itor := range indicators {
+			dd.indicatorsAddedCounter.Inc(worker.MetricLabels{"analytic": pgm, "type": itor.Type, "category": itor.Category})
+		}
 		if event.Indicators == nil {
 			inds := make([]*dt.Indicator, 0)
 			event.Indicators = &inds
 		}
-		// Set indicator probability to 1.0 (if not set)
-		for i, _ := range indicators {
-			if indicators[i].Probability == 0 {
-				indicators[i].Probability = 1.0
-			}
-		}
 		newInds := append(*event.Indicators, indicators...)
 		event.Indicators = &newInds
 	}
+	return alerts
 }
 
 // helper for testing
 var (
 	Send = func(w *worker.Worker, dest string, bs *[]byte) {
-		w.Send("output", *bs)
+		w.Send(dest, *bs)
 	}
 )
 
-func (dd *dynamicDetector) parseAlertData(alerts AlertsMessage) {
+// loads alerts from another dynamic detector. Timeouts are absolute times on
+// the sender's clock, so they are shifted by the difference between the
+// sender's clock and ours
+func (dd *dynamicDetector) parseAlertData(alerts AlertsMessage, source string) {
+	skew := dd.clockSkewAt(alerts.Now, alerts.Received)
+	dd.warnClockSkew(skew)
 	for _, alert := range alerts.Alerts {
-		dd.AddExistingAlert(alert.Alert, alert.Timeout)
+		validFrom := alert.ValidFrom
+		if validFrom != 0 {
+			validFrom += skew
+		}
+		dd.AddExistingAlertFrom(alert.Alert, validFrom, alert.Timeout+skew, source)
 	}
 }
 
-func (dd *dynamicDetector) initialAlertLoad() {
-	resp, err := http.Get("http://dynamicdetector:8081/alerts")
-	if err != nil {
-		// error getting the current state, assume that means there is
-		// no state to load
-		log.Warn("No state to load from http://dynamicdetector:8081/alerts, assuming " +
-			"this is the first dynamic detector and starting with empty state")
-		log.Info("error during initial load - ", err.Error())
-		return
+// works out how far our clock is ahead of a peer's, given the peer's clock.
+// Peers that do not send their clock are assumed to have no skew
+func (dd *dynamicDetector) clockSkew(peerNow int64) int64 {
+	return dd.clockSkewAt(peerNow, 0)
+}
+
+// works out the skew for a message with the peer's clock that arrived at
+// received on ours, zero meaning now
+func (dd *dynamicDetector) clockSkewAt(peerNow, received int64) int64 {
+	if peerNow == 0 {
+		return 0
 	}
-	alertJsonData, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
-	if err != nil {
-		log.Fatal(err)
+	if received == 0 {
+		received = dd.clock.Now().Unix()
 	}
-	// Read alerts.
-	var am AlertsMessage
-	err = json.Unmarshal(alertJsonData, &am)
-	if err != nil {
-		log.Fatal("Couldn't unmarshal json: %s", err.Error())
+	return received - peerNow
+}
+
+func (dd *dynamicDetector) warnClockSkew(skew int64) {
+	if skew > dd.clockSkewWarning || -skew > dd.clockSkewWarning {
+		log.Warn("clock skew of ", skew, " seconds with peer dynamic detector, correcting alert timeouts")
 	}
-	log.Info("loading initial state of ", len(am.Alerts), " alerts")
-	dd.parseAlertData(am)
 }
 
 func (dd *dynamicDetector) cleanup() {
 	worker.RemoveCounter(dd.indicatorsAddedCounter)
 	worker.RemoveGauge(dd.alertDBSizeGauge)
+	dd.metrics.cleanup()
+	dd.latency.cleanup()
+	worker.RemoveCounter(dd.alertsEvictedCounter)
+	dd.ttlPolicy.cleanup()
+	dd.antiEntropy.cleanup()
+	dd.retro.cleanup()
+	dd.audits.cleanup()
+}
+
+// applies state changes between events, so alerts, peer changes and repairs
+// do not back up when the event input is quiet. Stops the detector if the
+// alert receiver fails
+func (dd *dynamicDetector) updateStatePeriodically(ctx context.Context, stop context.CancelFunc) {
+	ticker := dd.clock.NewTicker(stateUpdateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-ctx.Done():
+			return
+		}
+		dd.handling.Lock()
+		err := dd.updateState()
+		dd.handling.Unlock()
+		if err != nil {
+			stop()
+			return
+		}
+	}
 }
 
 // iterate through all actions there are to take
 func (dd *dynamicDetector) updateState() error {
+	dd.latency.alertsBacklogGauge.Set(float64(len(dd.alertsCh)), worker.MetricLabels{"analytic": pgm})
 	for {
 		select {
 		case err := <-dd.alertErrors:
@@ -187,9 +510,13 @@ func (dd *dynamicDetector) updateState() error {
 			return err
 		case alert := <-dd.alertsCh:
 			dd.AddAlert(alert)
+		case change := <-dd.peerChanges:
+			dd.applyPeerChange(change, sourcePeer)
+		case change := <-dd.repairs:
+			dd.antiEntropy.repair(change)
 		case <-dd.timeout:
 			dd.TimeoutAlerts()
-			dd.timeout = time.After(5 * time.Second)
+			dd.timeout = dd.clock.After(5 * time.Second)
 		default:
 			return nil
 		}
@@ -197,37 +524,94 @@ func (dd *dynamicDetector) updateState() error {
 }
 
 func (dd *dynamicDetector) Handle(msg []uint8, w *worker.Worker) error {
+	dd.handling.Lock()
+	defer dd.handling.Unlock()
+
 	// check if there are other actions that need to happen first
 	err := dd.updateState()
 	if err != nil {
 		return err
 	}
 
+	dd.sendRetroHits(w)
+
+	j, ok := dd.processEvent(dd.liveView(), msg)
+	if !ok {
+		return nil
+	}
+
+	// Forward event record to output queue.
+	dd.send(w, "output", &j)
+	dd.retro.record(j, dd.clock.Now().Unix())
+
+	return nil
+}
+
+// adds any IOCs an event matches in the view. Events are first checked
+// against the prefilter with a partial decode, events without a hit are
+// returned as they were received and only events with a hit are decoded in
+// full, with the indicators spliced into the original JSON. Returns false
+// if the event couldn't be processed
+func (dd *dynamicDetector) processEvent(v *detectorView, msg []byte) ([]byte, bool) {
+	start := time.Now()
+	if v.prefilter != nil {
+		var partial matchableEvent
+		err := json.Unmarshal(msg, &partial)
+		if err != nil {
+			log.Errorf("Couldn't unmarshal json: %s", err.Error())
+			return nil, false
+		}
+		if !v.prefilter.mayMatch(partial.fields()) {
+			dd.observeEventTime(partial.Time)
+			dd.latency.observe(stageDecode, start)
+			return msg, true
+		}
+	}
+
 	// Read event, decode JSON.
 	var ev dt.Event
-	err = json.Unmarshal(msg, &ev)
+	err := json.Unmarshal(msg, &ev)
 	if err != nil {
 		log.Errorf("Couldn't unmarshal json: %s", err.Error())
-		return nil
+		return nil, false
 	}
+	dd.latency.observe(stageDecode, start)
 
 	// update the event to add any IOCs to it
-	dd.handleEvent(&ev)
+	before := 0
+	if ev.Indicators != nil {
+		before = len(*ev.Indicators)
+	}
+	start = time.Now()
+	dd.handleEventWith(v, &ev)
+	dd.latency.observe(stageLookup, start)
+	if ev.Indicators == nil || len(*ev.Indicators) == before {
+		return msg, true
+	}
 
-	// Convert event record back to JSON.
-	j, err := json.Marshal(ev)
+	start = time.Now()
+	defer dd.latency.observe(stageEncode, start)
+	j, err := spliceIndicators(msg, (*ev.Indicators)[before:])
+	if err == nil {
+		return j, true
+	}
+
+	// Convert event record back to JSON, losing any fields the event type
+	// does not have
+	log.Warn("couldn't add indicators to event JSON, encoding it again: ", err.Error())
+	j, err = json.Marshal(ev)
 	if err != nil {
 		log.Errorf("JSON marshal error: %s", err.Error())
-		return nil
+		return nil, false
 	}
-
-	// Forward event record to output queue.
-	Send(w, "output", &j)
-
-	return nil
+	return j, true
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replay(os.Args[2:]))
+	}
+
 	var w worker.QueueWorker
 	var det dynamicDetector
 	var aServer alertServer
@@ -251,19 +635,37 @@ func main() {
 	ctx, cancel := utils.ContextWithSigterm(ctx)
 	defer cancel()
 
-	det.alertsCh, det.alertErrors = RegisterForAlerts(ctx)
+	det.alertsCh, det.alertErrors = RegisterForAlerts(ctx, &det.status)
 	//   det.alertsCh = alertsCh
 	//   det.alertErrors = alertErrors
 
-	det.initialAlertLoad()
+	// serve health checks whilst loading, alerts are served once loaded
+	aServer.initAlertServer(&det)
 
-	aServer.initAlertServer(&det.alerts)
+	err := det.audits.start()
+	if err != nil {
+		log.Errorf("Couldn't open audit log: %s", err.Error())
+		return
+	}
+	defer det.audits.stop()
+
+	det.status.set(checkInitialLoad, false, "loading initial alert state")
+	det.initialAlertLoad(ctx)
+	det.status.set(checkInitialLoad, true, "initial alert state loaded")
+	go det.saveStatePeriodically(ctx)
+
+	if utils.Getenv("PEER_STREAM_SYNC", "false") == "true" {
+		det.peerChanges = streamFromPeer(ctx, &det.peerClient, det.peerURL, det.hostname)
+	}
+	det.repairs = det.antiEntropy.run(ctx)
+	go det.updateStatePeriodically(ctx, cancel)
 
-	err := w.Initialise(ctx, input, output, pgm)
+	err = w.Initialise(ctx, input, output, pgm)
 	if err != nil {
 		log.Errorf("Error on init: %s", err.Error())
 		return
 	}
+	det.status.set(checkWorkerInput, true, "attached to "+input)
 
 	log.Info("Initialisation complete.")
 
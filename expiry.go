@@ -0,0 +1,94 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	dt "github.com/trustnetworks/analytics-common/datatypes"
+	"github.com/trustnetworks/analytics-common/utils"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// alerts expire against the detector's clock
+	expiryProcessingTime = "processing-time"
+	// alerts expire against the time in the events, so a replay or a lagging
+	// input queue tags events with the alerts that were active when they
+	// happened
+	expiryEventTime = "event-time"
+)
+
+type expiryConfig struct {
+	mode string
+	// seconds the watermark is held back to allow for events arriving out
+	// of order
+	lateness int64
+	// latest event time seen, unix seconds. Accessed atomically so it can be
+	// read without the state lock
+	watermark int64
+}
+
+func (e *expiryConfig) init() {
+	e.mode = utils.Getenv("EXPIRY_MODE", expiryProcessingTime)
+	if e.mode != expiryProcessingTime && e.mode != expiryEventTime {
+		log.Error("Invalid EXPIRY_MODE ", e.mode, ", using ", expiryProcessingTime)
+		e.mode = expiryProcessingTime
+	}
+	lateness, err := strconv.ParseInt(utils.Getenv("EVENT_TIME_LATENESS", "60"), 10, 64)
+	if err != nil || lateness < 0 {
+		log.Error("Invalid EVENT_TIME_LATENESS, using 60 seconds")
+		lateness = 60
+	}
+	e.lateness = lateness
+	e.watermark = 0
+}
+
+func (e *expiryConfig) eventTime() bool {
+	return e.mode == expiryEventTime
+}
+
+// returns the time alerts are expired against. In event-time mode nothing
+// expires until events have been seen
+func (dd *dynamicDetector) expiryNow() int64 {
+	if dd.expiry.eventTime() {
+		return atomic.LoadInt64(&dd.expiry.watermark) - dd.expiry.lateness
+	}
+	return dd.clock.Now().Unix()
+}
+
+// returns the time of an event in unix seconds, false if it has no valid time
+func eventTime(event *dt.Event) (int64, bool) {
+	t, err := time.Parse(time.RFC3339Nano, event.Time)
+	if err != nil {
+		return 0, false
+	}
+	return t.Unix(), true
+}
+
+// advances the event-time watermark
+func (dd *dynamicDetector) observeEvent(event *dt.Event) {
+	dd.observeEventTime(event.Time)
+}
+
+func (dd *dynamicDetector) observeEventTime(eventTime string) {
+	if !dd.expiry.eventTime() {
+		return
+	}
+	parsed, err := time.Parse(time.RFC3339Nano, eventTime)
+	if err != nil {
+		return
+	}
+	t := parsed.Unix()
+	for {
+		watermark := atomic.LoadInt64(&dd.expiry.watermark)
+		if t <= watermark || atomic.CompareAndSwapInt64(&dd.expiry.watermark, watermark, t) {
+			return
+		}
+	}
+}
+
+// returns true if the alert was active at time t
+func (v *detectorView) activeAt(a Alert, t int64) bool {
+	timeout, ok := v.alerts[a]
+	return ok && v.validFrom[a] <= t && t <= timeout
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	dt "github.com/trustnetworks/analytics-common/datatypes"
+	"testing"
+	"time"
+)
+
+func TestEventTimeExpiryChecksAlertWindow(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+	dd.expiry.mode = expiryEventTime
+
+	a := Alert{
+		Device: "theatregoing-mac",
+		Type:   "dns",
+		Indicator: dt.Indicator{
+			Type:        "hostname",
+			Value:       "blah.com",
+			Category:    "covert.dns-tunnel",
+			Probability: 0.9,
+			Id:          "b1769a6b-80c0-40e5-9287-a9a5d4262741",
+		},
+		TTL: 10,
+	}
+	now := clock.Now()
+	dd.AddAlert(a)
+
+	tagged := func(at time.Time) bool {
+		event := loadEventFromFile("test_data/single-dns-tunnel-event.json", t)
+		event.Time = at.UTC().Format(time.RFC3339Nano)
+		dd.handleEvent(event)
+		return event.Indicators != nil && len(*event.Indicators) == 1
+	}
+
+	if tagged(now.Add(-5 * time.Second)) {
+		t.Error("event before the alert was raised should not be tagged")
+	}
+	if !tagged(now.Add(5 * time.Second)) {
+		t.Error("event whilst the alert was active should be tagged")
+	}
+	if tagged(now.Add(20 * time.Second)) {
+		t.Error("event after the alert expired should not be tagged, even if the alert is still loaded")
+	}
+
+	// processing time has not moved, the watermark minus lateness has not
+	// passed the timeout yet
+	dd.TimeoutAlerts()
+	if len(dd.alerts) != 1 {
+		t.Error("alert should not expire until the watermark passes it")
+	}
+	tagged(now.Add(time.Duration(dd.expiry.lateness+20) * time.Second))
+	dd.TimeoutAlerts()
+	if len(dd.alerts) != 0 {
+		t.Error("alert should expire once the event-time watermark passes it")
+	}
+	dd.cleanup()
+}
+
+func TestValidFromLoadedFromPeer(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+
+	now := clock.Now().Unix()
+	a := testSyncAlert()
+	a.TTL = 300
+	// peer clock is 10 seconds behind
+	dd.parseAlertData(AlertsMessage{
+		Alerts: []AlertData{{Alert: a, ValidFrom: now - 110, Timeout: now + 90}},
+		Now:    now - 10,
+	}, sourcePeer)
+	if dd.validFrom[a] != now-100 || dd.alerts[a] != now+100 {
+		t.Error("validity window should be corrected for clock skew, got ", dd.validFrom[a]-now, " to ", dd.alerts[a]-now)
+	}
+
+	// re-raising the alert extends it but keeps when it became active
+	dd.AddAlert(a)
+	if dd.validFrom[a] != now-100 {
+		t.Error("extending an alert should not change when it became active")
+	}
+
+	ad, ok := (&alertServer{dd: &dd}).getAlert(a.Key())
+	if !ok || ad.ValidFrom != now-100 {
+		t.Error("alert data should include when the alert became active")
+	}
+	dd.cleanup()
+}
+
+func TestEventTimeExpiryChecksAlertThatMatched(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+	dd.expiry.mode = expiryEventTime
+
+	indicator := dt.Indicator{
+		Type:        "hostname",
+		Value:       "blah.com",
+		Category:    "covert.dns-tunnel",
+		Probability: 0.9,
+		Id:          "b1769a6b-80c0-40e5-9287-a9a5d4262741",
+	}
+	// same indicator for another device, active first
+	other := Alert{Device: "other-mac", Type: "dns", Indicator: indicator, TTL: 10}
+	a := Alert{Device: "theatregoing-mac", Type: "dns", Indicator: indicator, TTL: 10}
+	now := clock.Now()
+	dd.AddAlert(other)
+	clock.Advance(30 * time.Second)
+	dd.AddAlert(a)
+
+	tagged := func(at time.Time) bool {
+		event := loadEventFromFile("test_data/single-dns-tunnel-event.json", t)
+		event.Time = at.UTC().Format(time.RFC3339Nano)
+		dd.handleEvent(event)
+		return event.Indicators != nil && len(*event.Indicators) == 1
+	}
+
+	if tagged(now.Add(5 * time.Second)) {
+		t.Error("event should not be tagged whilst only the alert for another device was active")
+	}
+	if !tagged(now.Add(35 * time.Second)) {
+		t.Error("event should be tagged whilst the alert for its device was active")
+	}
+	event := loadEventFromFile("test_data/single-dns-tunnel-event.json", t)
+	event.Time = now.Add(35 * time.Second).UTC().Format(time.RFC3339Nano)
+	dd.handleEvent(event)
+	if (*event.Indicators)[0].Id != indicator.Id {
+		t.Error("event should be tagged with the alert's indicator, got ", (*event.Indicators)[0].Id)
+	}
+	dd.cleanup()
+}
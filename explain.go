@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	dt "github.com/trustnetworks/analytics-common/datatypes"
+	"io/ioutil"
+	"net/http"
+	"sort"
+)
+
+// maximum size of an event accepted by the explain endpoint
+const maxExplainEventSize = 1 << 20
+
+// how a dynamic IOC matched, or failed to match, an event. Matched is the
+// result of the detector library lookup. Tree is an approximate breakdown by
+// node, TreeDisagrees is set when its result differs from the lookup
+type Candidate struct {
+	IOCID         string     `json:"ioc_id"`
+	AlertKey      string     `json:"alert_key"`
+	Alert         Alert      `json:"alert"`
+	Timeout       int64      `json:"timeout"`
+	Matched       bool       `json:"matched"`
+	Tree          NodeResult `json:"tree"`
+	TreeDisagrees bool       `json:"tree_disagrees,omitempty"`
+}
+
+type Explanation struct {
+	// indicators that would be added to the event
+	Indicators []*dt.Indicator `json:"indicators"`
+	Candidates []Candidate     `json:"candidates"`
+}
+
+// explains which dynamic IOCs an event matches. Candidates are the IOCs the
+// event matches or with at least one pattern matching it, or every IOC if all
+// is set
+func (dd *dynamicDetector) explain(event []byte, all bool) (Explanation, error) {
+	var ev dt.Event
+	err := json.Unmarshal(event, &ev)
+	if err != nil {
+		return Explanation{}, err
+	}
+	fields, err := extractEventFields(event)
+	if err != nil {
+		return Explanation{}, err
+	}
+
+	e := Explanation{Candidates: make([]Candidate, 0)}
+	dd.lock.RLock()
+	e.Indicators = dd.lookupIndicators(&ev)
+	// IOC roots are tagged with their ID
+	hits := make(map[string]bool)
+	for _, i := range dd.detectorLib.Lookup(&ev) {
+		hits[i.Id] = true
+	}
+	for a, ioc := range dd.alertToIOCMap {
+		if ioc == nil {
+			continue
+		}
+		r := matchNode(ioc, fields)
+		matched := hits[ioc.ID]
+		if !all && !matched && !r.anyPatternMatched() {
+			continue
+		}
+		e.Candidates = append(e.Candidates, Candidate{
+			IOCID:         ioc.ID,
+			AlertKey:      a.Key(),
+			Alert:         a,
+			Timeout:       dd.alerts[a],
+			Matched:       matched,
+			Tree:          r,
+			TreeDisagrees: r.Matched != matched,
+		})
+	}
+	dd.lock.RUnlock()
+
+	if e.Indicators == nil {
+		e.Indicators = make([]*dt.Indicator, 0)
+	}
+	sort.Slice(e.Candidates, func(i, j int) bool {
+		if e.Candidates[i].Matched != e.Candidates[j].Matched {
+			return e.Candidates[i].Matched
+		}
+		return e.Candidates[i].IOCID < e.Candidates[j].IOCID
+	})
+	return e, nil
+}
+
+// runs a posted event against the current dynamic IOCs without sending it
+// anywhere, /admin/explain[?all=true]
+func (as *alertServer) handleExplain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST an event to explain", http.StatusMethodNotAllowed)
+		return
+	}
+	event, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxExplainEventSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	e, err := as.dd.explain(event, r.URL.Query().Get("all") == "true")
+	if err != nil {
+		http.Error(w, "couldn't read event: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, e)
+}
+
+// returns true if two indicators are the same, ignoring probability which
+// is defaulted when indicators are added to events
+func sameIndicator(a, b *dt.Indicator) bool {
+	return a.Id == b.Id && a.Type == b.Type && a.Value == b.Value && a.Category == b.Category
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	dt "github.com/trustnetworks/analytics-common/datatypes"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExplainEvent(t *testing.T) {
+	var dd dynamicDetector
+	dd.Init()
+
+	a := Alert{
+		Device: "theatregoing-mac",
+		Type:   "dns",
+		Indicator: dt.Indicator{
+			Type:        "hostname",
+			Value:       "blah.com",
+			Category:    "covert.dns-tunnel",
+			Probability: 0.9,
+			Id:          "b1769a6b-80c0-40e5-9287-a9a5d4262741",
+		},
+		TTL: 10,
+	}
+	otherDevice := a
+	otherDevice.Device = "another-dev"
+	unrelated := a
+	unrelated.Device = "another-dev"
+	unrelated.Indicator.Value = "a.tunnel.com"
+	dd.AddAlert(a)
+	dd.AddAlert(otherDevice)
+	dd.AddAlert(unrelated)
+
+	event := loadEventAsUint8sFromFile("test_data/single-dns-tunnel-event.json", t)
+
+	var as alertServer
+	as.dd = &dd
+	rec := httptest.NewRecorder()
+	as.handleExplain(rec, httptest.NewRequest("POST", "/admin/explain", bytes.NewReader(*event)))
+
+	var e Explanation
+	err := json.Unmarshal(rec.Body.Bytes(), &e)
+	if err != nil {
+		t.Fatal("JSON unmarshal error: ", err.Error(), " body: ", rec.Body.String())
+	}
+	if len(e.Indicators) != 1 || e.Indicators[0].Value != "blah.com" {
+		t.Error("explain should return the indicators that would be added")
+	}
+	if len(e.Candidates) != 2 {
+		t.Fatal("IOCs with a matching pattern should be candidates, got ", len(e.Candidates))
+	}
+	if !e.Candidates[0].Matched || e.Candidates[0].Alert != a {
+		t.Error("matching IOC should be listed first as matched")
+	}
+	if e.Candidates[1].Matched || e.Candidates[1].Alert != otherDevice {
+		t.Error("IOC for another device should be a candidate that did not match")
+	}
+	for _, c := range e.Candidates {
+		if c.TreeDisagrees || c.Tree.Matched != c.Matched {
+			t.Error("node breakdown should agree with the lookup for ", c.Alert.Device)
+		}
+	}
+	for _, node := range e.Candidates[1].Tree.Children {
+		if node.Pattern.Type == "device" && node.Matched {
+			t.Error("device node should be reported as failing for another device")
+		}
+		if node.Pattern.Type == "hostname" && !node.Matched {
+			t.Error("hostname node should be reported as matching")
+		}
+	}
+
+	if len(*event) != len(*loadEventAsUint8sFromFile("test_data/single-dns-tunnel-event.json", t)) {
+		t.Error("explain should not change the event")
+	}
+	dd.cleanup()
+}
+
+func TestMatchNodeOperators(t *testing.T) {
+	ioc := loadIOCFromFile("test_data/not-ioc.json", t)
+
+	fields := eventFields{"hostname": {"www.kali.org"}, "device": {"another-dev"}}
+	if !matchNode(ioc, fields).Matched {
+		t.Error("hostname under OR with device not excluded by NOT should match")
+	}
+
+	fields = eventFields{"hostname": {"www.kali.org"}, "device": {"theatregoing-mac"}}
+	r := matchNode(ioc, fields)
+	if r.Matched {
+		t.Error("device excluded by NOT should not match")
+	}
+	if !r.anyPatternMatched() {
+		t.Error("event should be related to the IOC even though it did not match")
+	}
+
+	fields = eventFields{"hostname": {"notkali.org"}}
+	if matchNode(ioc, fields).Matched {
+		t.Error("dns match should only match the domain and its subdomains")
+	}
+}
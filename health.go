@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+const (
+	checkInitialLoad   = "initial_load"
+	checkAlertConsumer = "alert_consumer"
+	checkWorkerInput   = "worker_input"
+)
+
+type checkState struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+	// unix time the check last changed
+	Since int64 `json:"since"`
+}
+
+// readiness checks of the dynamic detector, updated from whichever goroutine
+// is doing the work being checked
+type detectorStatus struct {
+	lock   sync.RWMutex
+	checks map[string]checkState
+	clock  Clock
+}
+
+func (s *detectorStatus) init(clock Clock) {
+	s.clock = clock
+	s.checks = map[string]checkState{
+		checkInitialLoad:   {Detail: "initial alert load not started"},
+		checkAlertConsumer: {Detail: "alert consumer not started"},
+		checkWorkerInput:   {Detail: "worker input not attached"},
+	}
+}
+
+func (s *detectorStatus) set(check string, ok bool, detail string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.checks == nil {
+		s.init(realClock{})
+	}
+	s.checks[check] = checkState{OK: ok, Detail: detail, Since: s.clock.Now().Unix()}
+}
+
+func (s *detectorStatus) ok(check string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.checks[check].OK
+}
+
+type statusReport struct {
+	Ready  bool                  `json:"ready"`
+	Checks map[string]checkState `json:"checks"`
+	Alerts int                   `json:"alerts"`
+}
+
+func (s *detectorStatus) report() statusReport {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	r := statusReport{Ready: true, Checks: make(map[string]checkState)}
+	for name, c := range s.checks {
+		r.Checks[name] = c
+		if !c.OK {
+			r.Ready = false
+		}
+	}
+	return r
+}
+
+func (as *alertServer) statusReport() statusReport {
+	r := as.dd.status.report()
+	as.dd.lock.RLock()
+	r.Alerts = len(as.dd.alerts)
+	as.dd.lock.RUnlock()
+	return r
+}
+
+func writeStatus(w http.ResponseWriter, status int, r statusReport) {
+	js, _ := json.Marshal(r)
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+// wraps a handler to refuse requests for alert state until the initial load
+// has finished, so a peer never loads an incomplete state from us
+func (as *alertServer) afterLoad(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !as.dd.status.ok(checkInitialLoad) {
+			http.Error(w, "initial alert load in progress", http.StatusServiceUnavailable)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// liveness, the alert server is answering so the process is alive. The
+// status of the readiness checks is included for information
+func (as *alertServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, http.StatusOK, as.statusReport())
+}
+
+// readiness, only ready once the initial state is loaded, alerts are being
+// consumed and the worker is attached to its input
+func (as *alertServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	report := as.statusReport()
+	status := http.StatusOK
+	if !report.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeStatus(w, status, report)
+}
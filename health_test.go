@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadyOnlyWhenAllChecksPass(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+	var as alertServer
+	as.dd = &dd
+
+	rec := httptest.NewRecorder()
+	as.handleReadyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != 503 {
+		t.Error("should not be ready before initial load, got ", rec.Code)
+	}
+
+	dd.status.set(checkInitialLoad, true, "loaded")
+	dd.status.set(checkAlertConsumer, true, "consuming")
+	rec = httptest.NewRecorder()
+	as.handleReadyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != 503 {
+		t.Error("should not be ready before worker input attached, got ", rec.Code)
+	}
+	var report statusReport
+	json.Unmarshal(rec.Body.Bytes(), &report)
+	if report.Ready || report.Checks[checkWorkerInput].OK || !report.Checks[checkInitialLoad].OK {
+		t.Error("status report should explain which check is failing: ", rec.Body.String())
+	}
+
+	clock.Advance(30 * time.Second)
+	dd.status.set(checkWorkerInput, true, "attached")
+	rec = httptest.NewRecorder()
+	as.handleReadyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != 200 {
+		t.Error("should be ready once all checks pass, got ", rec.Code)
+	}
+	report = statusReport{}
+	json.Unmarshal(rec.Body.Bytes(), &report)
+	if report.Checks[checkWorkerInput].Since != clock.Now().Unix() {
+		t.Error("checks should record when they changed on the detector's clock")
+	}
+
+	dd.status.set(checkAlertConsumer, false, "alert consumer stopped")
+	rec = httptest.NewRecorder()
+	as.handleReadyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != 503 {
+		t.Error("should not be ready once alert consumer stops, got ", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	as.handleHealthz(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != 200 {
+		t.Error("should be live whilst not ready, got ", rec.Code)
+	}
+	dd.cleanup()
+}
+
+func TestAlertStateNotServedDuringInitialLoad(t *testing.T) {
+	var dd dynamicDetector
+	dd.Init()
+	var as alertServer
+	as.dd = &dd
+	handler := as.afterLoad(as.handle)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/alerts", nil))
+	if rec.Code != 503 {
+		t.Error("alert state should not be served before the initial load, got ", rec.Code)
+	}
+
+	dd.status.set(checkInitialLoad, true, "loaded")
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/alerts", nil))
+	if rec.Code != 200 {
+		t.Error("alert state should be served after the initial load, got ", rec.Code)
+	}
+	dd.cleanup()
+}
+
+func TestProbesServedWithoutAlerts(t *testing.T) {
+	var dd dynamicDetector
+	dd.Init()
+	var as alertServer
+	as.dd = &dd
+	mux := as.probeMux()
+
+	for path, code := range map[string]int{"/healthz": 200, "/readyz": 503, "/alerts": 404} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != code {
+			t.Error("probe server should return ", code, " for ", path, ", got ", rec.Code)
+		}
+	}
+	dd.cleanup()
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/trustnetworks/analytics-common/utils"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the time an alert was active, from when it became active until it expired
+// or was removed. Intervals of alerts still stored have no end
+type AlertInterval struct {
+	Key   string `json:"key"`
+	Alert Alert  `json:"alert"`
+	From  int64  `json:"from"`
+	Until int64  `json:"until,omitempty"`
+	// expired, revoked or evicted, empty if the alert is still stored
+	Ended string `json:"ended,omitempty"`
+	// timeout of an alert still stored
+	Timeout int64 `json:"timeout,omitempty"`
+}
+
+type AlertHistoryMessage struct {
+	Intervals []AlertInterval `json:"intervals"`
+	Now       int64           `json:"now,omitempty"`
+	// intervals ending before this time may have been dropped from the
+	// history, answers for earlier times can be incomplete
+	CompleteFrom int64 `json:"complete_from,omitempty"`
+	// cursor for the next page of a paginated query, empty on the last page
+	Next string `json:"next,omitempty"`
+}
+
+// bounded history of the intervals alerts were active for, oldest intervals
+// are dropped first. Only changed with the state lock held
+type alertHistory struct {
+	maxIntervals int
+	// ring buffer of intervals once full, oldest is overwritten first
+	intervals []AlertInterval
+	// index of the oldest interval once full
+	oldest int
+	// latest end of the intervals dropped
+	droppedUntil int64
+}
+
+func (h *alertHistory) init() {
+	max, err := strconv.Atoi(utils.Getenv("ALERT_HISTORY_MAX", "100000"))
+	if err != nil || max < 0 {
+		log.Error("Invalid ALERT_HISTORY_MAX, using 100000")
+		max = 100000
+	}
+	h.maxIntervals = max
+	h.intervals = make([]AlertInterval, 0)
+	h.oldest = 0
+	h.droppedUntil = 0
+}
+
+func (h *alertHistory) add(i AlertInterval) {
+	if h.maxIntervals == 0 {
+		return
+	}
+	if len(h.intervals) < h.maxIntervals {
+		h.intervals = append(h.intervals, i)
+		return
+	}
+	if d := h.intervals[h.oldest]; d.Until > h.droppedUntil {
+		h.droppedUntil = d.Until
+	}
+	h.intervals[h.oldest] = i
+	h.oldest = (h.oldest + 1) % len(h.intervals)
+}
+
+// records the interval of an alert being removed, the state lock must be held
+func (dd *dynamicDetector) endInterval(a Alert, change string) {
+	until := dd.alerts[a]
+	if change != alertExpired && dd.expiryNow() < until {
+		until = dd.expiryNow()
+	}
+	dd.history.add(AlertInterval{
+		Key:   a.Key(),
+		Alert: a,
+		From:  dd.validFrom[a],
+		Until: until,
+		Ended: change,
+	})
+}
+
+// a time, or an interval, to find the alerts active in
+type historyQuery struct {
+	alertQuery
+	from int64
+	to   int64
+	// the cursor is the key and start of the last interval returned, as an
+	// alert can have several intervals
+	cursorFrom int64
+}
+
+// returns the cursor to continue after an interval from
+func historyCursor(i AlertInterval) string {
+	return i.Key + "@" + strconv.FormatInt(i.From, 10)
+}
+
+// returns true if the interval comes after the cursor, ordered by key then
+// start
+func (q *historyQuery) afterCursor(i AlertInterval) bool {
+	if q.cursor == "" || i.Key != q.cursor {
+		return i.Key > q.cursor
+	}
+	return i.From > q.cursorFrom
+}
+
+func parseHistoryQuery(v url.Values) (historyQuery, error) {
+	var q historyQuery
+	var err error
+	q.alertQuery, err = parseAlertQuery(v)
+	if err != nil {
+		return q, err
+	}
+	if q.cursor != "" {
+		parts := strings.SplitN(q.cursor, "@", 2)
+		if len(parts) == 2 {
+			q.cursorFrom, err = strconv.ParseInt(parts[1], 10, 64)
+		}
+		if len(parts) != 2 || err != nil {
+			return q, errors.New("cursor must be the next cursor from a previous page")
+		}
+		q.cursor = parts[0]
+	}
+	if s := v.Get("at"); s != "" {
+		q.from, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return q, errors.New("at must be a unix time in seconds")
+		}
+		q.to = q.from
+		return q, nil
+	}
+	q.from, err = strconv.ParseInt(v.Get("from"), 10, 64)
+	if err != nil {
+		return q, errors.New("at, or from and to, must be unix times in seconds")
+	}
+	q.to, err = strconv.ParseInt(v.Get("to"), 10, 64)
+	if err != nil || q.to < q.from {
+		return q, errors.New("to must be a unix time in seconds, not before from")
+	}
+	return q, nil
+}
+
+// returns true if an alert active from from until until was active at any
+// time in the query. An alert is active until, but not at, its end
+func (q *historyQuery) overlaps(from, until int64) bool {
+	return from <= q.to && until > q.from
+}
+
+// returns the alerts that were active at the query time or during the query
+// interval, both those in the history and those still stored. Pages through
+// them like /alerts, ordered by key then start
+func (dd *dynamicDetector) alertsActiveDuring(q historyQuery) AlertHistoryMessage {
+	var hm AlertHistoryMessage
+	hm.Intervals = make([]AlertInterval, 0)
+
+	dd.lock.RLock()
+	hm.Now = dd.clock.Now().Unix()
+	hm.CompleteFrom = dd.history.droppedUntil
+	include := func(i AlertInterval, until int64) bool {
+		return (q.bucket < 0 || digestBucket(i.Key) == q.bucket) &&
+			q.afterCursor(i) && q.overlaps(i.From, until) && q.matches(i.Alert, until)
+	}
+	for _, i := range dd.history.intervals {
+		if include(i, i.Until) {
+			hm.Intervals = append(hm.Intervals, i)
+		}
+	}
+	// an alert still stored can have a later interval than the cursor's
+	for _, key := range dd.index.from(q.cursor) {
+		a, _ := dd.index.get(key)
+		i := AlertInterval{Key: key, Alert: a, From: dd.validFrom[a], Timeout: dd.alerts[a]}
+		if include(i, i.Timeout) {
+			hm.Intervals = append(hm.Intervals, i)
+		}
+	}
+	dd.lock.RUnlock()
+
+	sort.SliceStable(hm.Intervals, func(i, j int) bool {
+		if hm.Intervals[i].Key != hm.Intervals[j].Key {
+			return hm.Intervals[i].Key < hm.Intervals[j].Key
+		}
+		return hm.Intervals[i].From < hm.Intervals[j].From
+	})
+	if q.limit > 0 && len(hm.Intervals) > q.limit {
+		hm.Intervals = hm.Intervals[:q.limit]
+		hm.Next = historyCursor(hm.Intervals[q.limit-1])
+	}
+	return hm
+}
+
+// alerts active at a past time, /alerts/history?at=<time> or
+// /alerts/history?from=<time>&to=<time>, filtered and paged like /alerts
+func (as *alertServer) handleHistory(w http.ResponseWriter, r *http.Request) {
+	q, err := parseHistoryQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, as.dd.alertsActiveDuring(q))
+}
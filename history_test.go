@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func queryHistory(as *alertServer, url string, t *testing.T) AlertHistoryMessage {
+	rec := httptest.NewRecorder()
+	as.handleHistory(rec, httptest.NewRequest("GET", url, nil))
+
+	var hm AlertHistoryMessage
+	err := json.Unmarshal(rec.Body.Bytes(), &hm)
+	if err != nil {
+		t.Fatal("JSON unmarshal error: ", err.Error(), " body: ", rec.Body.String())
+	}
+	return hm
+}
+
+func TestHistoryAlertsActiveAtTime(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+	var as alertServer
+	as.dd = &dd
+
+	start := clock.Now().Unix()
+	expired := testSyncAlert()
+	revoked := testSyncAlert()
+	revoked.Device = "b-dev"
+	stored := testSyncAlert()
+	stored.Device = "c-dev"
+	for _, a := range []*Alert{&expired, &revoked, &stored} {
+		a.TTL = 3600
+	}
+
+	dd.AddExistingAlert(expired, start+100)
+	dd.AddExistingAlert(revoked, start+1000)
+	clock.Advance(50 * time.Second)
+	dd.AddExistingAlert(stored, start+1000)
+	clock.Advance(100 * time.Second)
+	dd.RevokeAlert(revoked, sourcePeer)
+	dd.TimeoutAlerts()
+
+	at := func(offset int64) string {
+		return "/alerts/history?at=" + strconv.FormatInt(start+offset, 10)
+	}
+	active := func(hm AlertHistoryMessage) map[Alert]AlertInterval {
+		m := make(map[Alert]AlertInterval)
+		for _, i := range hm.Intervals {
+			m[i.Alert] = i
+		}
+		return m
+	}
+	hm := queryHistory(&as, at(10), t)
+	found := active(hm)
+	if len(hm.Intervals) != 2 || len(found) != 2 {
+		t.Fatal("alerts no longer stored should be found active in the past, got ", hm.Intervals)
+	}
+	if i := found[expired]; i.Until != start+100 || i.Ended != alertExpired {
+		t.Error("expired alert should be active until it timed out, got ", i)
+	}
+	if i := found[revoked]; i.Until != start+150 || i.Ended != alertRevoked {
+		t.Error("revoked alert should be active until it was revoked, got ", i)
+	}
+
+	hm = queryHistory(&as, at(120), t)
+	found = active(hm)
+	if _, ok := found[expired]; ok || len(hm.Intervals) != 2 {
+		t.Error("alert should not be active after it expired, got ", hm.Intervals)
+	}
+	if i, ok := found[stored]; !ok || i.Timeout != start+1000 || i.Until != 0 {
+		t.Error("alerts still stored should have no end, got ", i)
+	}
+
+	hm = queryHistory(&as, "/alerts/history?device=a-dev&from="+strconv.FormatInt(start+90, 10)+
+		"&to="+strconv.FormatInt(start+200, 10), t)
+	if len(hm.Intervals) != 1 || hm.Intervals[0].Alert != expired {
+		t.Error("interval query should return filtered alerts active at any time in it, got ", hm.Intervals)
+	}
+
+	rec := httptest.NewRecorder()
+	as.handleHistory(rec, httptest.NewRequest("GET", "/alerts/history?from=10", nil))
+	if rec.Code != 400 {
+		t.Error("query without a time or a complete interval should be rejected")
+	}
+	dd.cleanup()
+}
+
+func TestHistoryPagination(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+	var as alertServer
+	as.dd = &dd
+
+	start := clock.Now().Unix()
+	a := testSyncAlert()
+	b := testSyncAlert()
+	b.Device = "b-dev"
+	c := testSyncAlert()
+	c.Device = "c-dev"
+	dd.AddAlert(a)
+	dd.AddAlert(b)
+	clock.Advance(10 * time.Second)
+	dd.RevokeAlert(a, sourcePeer)
+	clock.Advance(10 * time.Second)
+	// a second interval for the same alert
+	dd.AddAlert(a)
+	dd.AddAlert(c)
+
+	url := "/alerts/history?from=" + strconv.FormatInt(start, 10) + "&to=" + strconv.FormatInt(start+30, 10)
+	all := queryHistory(&as, url, t)
+	if len(all.Intervals) != 4 || all.Next != "" {
+		t.Fatal("expected 4 intervals on one page, got ", all.Intervals)
+	}
+
+	var paged []AlertInterval
+	cursor := ""
+	for pages := 0; pages < 10; pages++ {
+		hm := queryHistory(&as, url+"&limit=1&cursor="+cursor, t)
+		paged = append(paged, hm.Intervals...)
+		if hm.Next == "" {
+			break
+		}
+		cursor = hm.Next
+	}
+	if len(paged) != len(all.Intervals) {
+		t.Fatal("paging should return every interval once, got ", paged)
+	}
+	for i := range paged {
+		if paged[i] != all.Intervals[i] {
+			t.Error("page ", i, " should be ", all.Intervals[i], " got ", paged[i])
+		}
+	}
+
+	bucket := digestBucket(a.Key())
+	hm := queryHistory(&as, url+"&bucket="+strconv.Itoa(bucket), t)
+	for _, i := range hm.Intervals {
+		if digestBucket(i.Key) != bucket {
+			t.Error("intervals should be filtered by bucket, got ", i)
+		}
+	}
+	if len(hm.Intervals) < 2 {
+		t.Error("both intervals of the alert should be in its bucket, got ", hm.Intervals)
+	}
+
+	rec := httptest.NewRecorder()
+	as.handleHistory(rec, httptest.NewRequest("GET", url+"&cursor="+a.Key(), nil))
+	if rec.Code != 400 {
+		t.Error("cursor that isn't from a previous page should be rejected, got ", rec.Code)
+	}
+	dd.cleanup()
+}
+
+func TestHistoryIsBounded(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+	dd.history.maxIntervals = 1
+
+	now := clock.Now().Unix()
+	a := testSyncAlert()
+	b := testSyncAlert()
+	b.Device = "b-dev"
+	dd.AddExistingAlert(a, now+10)
+	dd.AddExistingAlert(b, now+20)
+	clock.Advance(30 * time.Second)
+	dd.TimeoutAlerts()
+
+	if len(dd.history.intervals) != 1 {
+		t.Fatal("history should be limited to the maximum number of intervals")
+	}
+	kept := dd.history.intervals[0].Until
+	if dd.history.droppedUntil == 0 || dd.history.droppedUntil == kept {
+		t.Error("history should report when it is complete from after dropping intervals")
+	}
+	dd.cleanup()
+}
+
+func TestHistoryKeepsNewestIntervals(t *testing.T) {
+	var h alertHistory
+	h.init()
+	h.maxIntervals = 2
+	for until := int64(1); until <= 5; until++ {
+		h.add(AlertInterval{Until: until})
+	}
+
+	kept := make(map[int64]bool)
+	for _, i := range h.intervals {
+		kept[i.Until] = true
+	}
+	if len(h.intervals) != 2 || !kept[4] || !kept[5] {
+		t.Error("history should keep the newest intervals, got ", h.intervals)
+	}
+	if h.droppedUntil != 3 {
+		t.Error("history should be complete from the end of the last interval dropped, got ", h.droppedUntil)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/trustnetworks/analytics-common/utils"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// where and how to load the initial alert state from
+type initialLoadConfig struct {
+	// base URLs of alert servers to load from
+	peers []string
+	// DNS SRV name to discover alert servers from, used as well as peers
+	srv     string
+	retries int
+	timeout time.Duration
+}
+
+func (c *initialLoadConfig) init(peerURL string) {
+	c.peers = make([]string, 0)
+	for _, p := range strings.Split(utils.Getenv("PEER_URLS", peerURL), ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			c.peers = append(c.peers, strings.TrimSuffix(p, "/"))
+		}
+	}
+	c.srv = utils.Getenv("PEER_SRV", "")
+
+	retries, err := strconv.Atoi(utils.Getenv("INITIAL_LOAD_RETRIES", "3"))
+	if err != nil || retries < 0 {
+		log.Error("Invalid INITIAL_LOAD_RETRIES, using 3")
+		retries = 3
+	}
+	c.retries = retries
+
+	timeout, err := strconv.Atoi(utils.Getenv("INITIAL_LOAD_TIMEOUT", "30"))
+	if err != nil || timeout <= 0 {
+		log.Error("Invalid INITIAL_LOAD_TIMEOUT, using 30 seconds")
+		timeout = 30
+	}
+	c.timeout = time.Duration(timeout) * time.Second
+}
+
+// works out the alert servers to load from, the configured peers plus any
+// found from the SRV record
+func (c *initialLoadConfig) discoverPeers(scheme string) []string {
+	peers := append([]string{}, c.peers...)
+	if c.srv == "" {
+		return peers
+	}
+	_, addrs, err := net.LookupSRV("", "", c.srv)
+	if err != nil {
+		log.Warn("Couldn't look up peers from SRV record ", c.srv, ": ", err.Error())
+		return peers
+	}
+	for _, addr := range addrs {
+		host := strings.TrimSuffix(addr.Target, ".")
+		peers = append(peers, scheme+"://"+net.JoinHostPort(host, strconv.Itoa(int(addr.Port))))
+	}
+	return peers
+}
+
+// gets alerts from a peer's alert server, streaming the decode rather than
+// reading the whole body first. The time the response headers arrived is
+// recorded so the clock skew doesn't include the time the body took
+func fetchPeerAlerts(ctx context.Context, pc *peerClient, url string) (AlertsMessage, error) {
+	var am AlertsMessage
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return am, err
+	}
+	setAlertsRequestHeaders(req)
+	resp, err := pc.do(ctx, req)
+	if err != nil {
+		return am, err
+	}
+	defer resp.Body.Close()
+	received := pc.clock.Now().Unix()
+	if resp.StatusCode != http.StatusOK {
+		return am, errors.New("unexpected status " + resp.Status)
+	}
+
+	err = decodeAlerts(resp, &am)
+	if err != nil {
+		return AlertsMessage{}, errors.New("couldn't decode alert state: " + err.Error())
+	}
+	// gob does not encode empty slices, a peer with no alerts decodes as nil
+	if am.Alerts == nil {
+		am.Alerts = []AlertData{}
+	}
+	am.Received = received
+	return am, nil
+}
+
+// gets the alert state from a peer. Alerts that are missing required fields
+// are dropped
+func fetchPeerState(ctx context.Context, pc *peerClient, peer string) (AlertsMessage, error) {
+	am, err := fetchPeerAlerts(ctx, pc, peer+"/alerts")
+	if err != nil {
+		return am, err
+	}
+
+	valid := am.Alerts[:0]
+	for _, ad := range am.Alerts {
+		if ad.Alert.Type == "" || ad.Timeout <= 0 {
+			continue
+		}
+		valid = append(valid, ad)
+	}
+	if len(valid) != len(am.Alerts) {
+		log.Warn("dropped ", len(am.Alerts)-len(valid), " invalid alerts from ", peer)
+	}
+	am.Alerts = valid
+	return am, nil
+}
+
+// returns true if the candidate state is a better one to load than best,
+// preferring the most active alerts then the most recent. now is used for
+// states without the sender's clock
+func betterState(candidate, best AlertsMessage, now int64) bool {
+	active := func(am AlertsMessage) int {
+		at := now
+		if am.Now != 0 {
+			at = am.Now
+		}
+		n := 0
+		for _, ad := range am.Alerts {
+			if ad.Timeout > at {
+				n++
+			}
+		}
+		return n
+	}
+	c, b := active(candidate), active(best)
+	if c != b {
+		return c > b
+	}
+	return candidate.Now > best.Now
+}
+
+// loads the current alert state from other dynamic detectors, retrying with
+// backoff. If no peer responds the state saved locally is loaded instead, if
+// there is none this is assumed to be the first dynamic detector
+func (dd *dynamicDetector) initialAlertLoad(ctx context.Context) {
+	var best AlertsMessage
+	loaded := false
+	backoff := time.Second
+
+	for attempt := 0; attempt <= dd.initialLoad.retries && !loaded; attempt++ {
+		if attempt > 0 {
+			log.Info("retrying initial load in ", backoff)
+			select {
+			case <-dd.clock.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff *= 2
+		}
+
+		for _, peer := range dd.initialLoad.discoverPeers(dd.peerClient.scheme) {
+			reqCtx, cancel := context.WithTimeout(ctx, dd.initialLoad.timeout)
+			am, err := fetchPeerState(reqCtx, &dd.peerClient, peer)
+			cancel()
+			if err != nil {
+				log.Warn("No state loaded from ", peer, ": ", err.Error())
+				continue
+			}
+			log.Info(peer, " has ", len(am.Alerts), " alerts")
+			if !loaded || betterState(am, best, dd.clock.Now().Unix()) {
+				best = am
+				loaded = true
+			}
+		}
+	}
+
+	if loaded {
+		log.Info("loading initial state of ", len(best.Alerts), " alerts")
+		dd.parseAlertData(best, sourcePeer)
+		return
+	}
+
+	if dd.stateFile != "" {
+		am, err := loadStateFile(dd.stateFile)
+		if err == nil {
+			log.Info("no peer state available, loading ", len(am.Alerts), " alerts from ", dd.stateFile)
+			dd.parseAlertData(am, sourceStateFile)
+			return
+		}
+		log.Warn("Couldn't load state from ", dd.stateFile, ": ", err.Error())
+	}
+
+	log.Warn("No state to load, assuming this is the first dynamic detector " +
+		"and starting with empty state")
+}
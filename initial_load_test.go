@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func peerServer(body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+}
+
+func TestInitialLoadPicksMostCompletePeer(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	now := clock.Now()
+	a := testSyncAlert()
+	a2 := a
+	a2.Indicator.Value = "a.tunnel.com"
+
+	small, _ := json.Marshal(AlertsMessage{
+		Alerts: []AlertData{{Alert: a, Timeout: now.Unix() + 30}},
+		Now:    now.Unix(),
+	})
+	large, _ := json.Marshal(AlertsMessage{
+		Alerts: []AlertData{{Alert: a, Timeout: now.Unix() + 30}, {Alert: a2, Timeout: now.Unix() + 30}},
+		Now:    now.Unix(),
+	})
+	corrupt := peerServer(`{"alerts": [{"alert": {"type": "dns"`)
+	defer corrupt.Close()
+	smallPeer := peerServer(string(small))
+	defer smallPeer.Close()
+	largePeer := peerServer(string(large))
+	defer largePeer.Close()
+
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+	dd.initialLoad.peers = []string{corrupt.URL, smallPeer.URL, largePeer.URL}
+	dd.initialLoad.retries = 0
+
+	dd.initialAlertLoad(context.Background())
+
+	if len(dd.alerts) != 2 {
+		t.Error("should load the state from the peer with the most alerts, loaded ", len(dd.alerts))
+	}
+	dd.cleanup()
+}
+
+func TestInitialLoadFallsBackToStateFile(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	now := clock.Now()
+	dir, err := ioutil.TempDir("", "dynamic-detector")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	var saved dynamicDetector
+	saved.clock = clock
+	saved.Init()
+	a := testSyncAlert()
+	saved.AddAlert(a)
+	err = saved.saveState(stateFile)
+	if err != nil {
+		t.Fatal("couldn't save state: ", err.Error())
+	}
+	saved.cleanup()
+
+	// restart 10 seconds later with no peers available
+	clock.Set(now.Add(10 * time.Second))
+	corrupt := peerServer("not json")
+	defer corrupt.Close()
+
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+	dd.initialLoad.peers = []string{corrupt.URL}
+	dd.initialLoad.retries = 0
+	dd.stateFile = stateFile
+
+	dd.initialAlertLoad(context.Background())
+
+	if len(dd.alerts) != 1 {
+		t.Fatal("state should be loaded from the state file when no peers respond")
+	}
+	if dd.alerts[a] != now.Unix()+a.TTL {
+		t.Error("timeouts from the state file should not be shifted by the time it was saved")
+	}
+	dd.cleanup()
+}
+
+func TestInitialLoadWithNoStateStartsEmpty(t *testing.T) {
+	var dd dynamicDetector
+	dd.Init()
+	dd.initialLoad.peers = []string{"http://127.0.0.1:1"}
+	dd.initialLoad.retries = 0
+
+	dd.initialAlertLoad(context.Background())
+
+	if len(dd.alerts) != 0 {
+		t.Error("should start with empty state when there is nothing to load")
+	}
+	dd.cleanup()
+}
+
+func TestInitialLoadFromEmptyPeer(t *testing.T) {
+	var peer dynamicDetector
+	peer.Init()
+	var as alertServer
+	as.dd = &peer
+	server := httptest.NewServer(http.HandlerFunc(as.handle))
+	defer server.Close()
+
+	var dd dynamicDetector
+	dd.Init()
+	am, err := fetchPeerState(context.Background(), &dd.peerClient, server.URL)
+	if err != nil {
+		t.Fatal("empty state from a peer should load: ", err.Error())
+	}
+	if am.Alerts == nil || len(am.Alerts) != 0 {
+		t.Error("empty state should have an empty alerts list, got ", am.Alerts)
+	}
+	if am.Now == 0 {
+		t.Error("state should be decoded from the binary encoding")
+	}
+	dd.cleanup()
+	peer.cleanup()
+}
+
+// response body that moves the clock on when it is first read, as if the
+// body took that long to arrive after the headers
+type slowBody struct {
+	io.ReadCloser
+	clock *fakeClock
+	delay time.Duration
+	once  sync.Once
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	b.once.Do(func() { b.clock.Advance(b.delay) })
+	return b.ReadCloser.Read(p)
+}
+
+type slowBodyTransport struct {
+	clock *fakeClock
+	delay time.Duration
+}
+
+func (t slowBodyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err == nil {
+		resp.Body = &slowBody{ReadCloser: resp.Body, clock: t.clock, delay: t.delay}
+	}
+	return resp, err
+}
+
+func TestClockSkewMeasuredWhenHeadersArrive(t *testing.T) {
+	start := time.Now()
+	peerClock := newFakeClock(start)
+	var peer dynamicDetector
+	peer.clock = peerClock
+	peer.Init()
+	a := testSyncAlert()
+	a.TTL = 300
+	peer.AddAlert(a)
+	var as alertServer
+	as.dd = &peer
+	server := httptest.NewServer(http.HandlerFunc(as.handle))
+	defer server.Close()
+
+	// same clock as the peer, but the body takes 30 seconds
+	clock := newFakeClock(start)
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+	dd.peerClient.client.Transport = slowBodyTransport{clock: clock, delay: 30 * time.Second}
+
+	am, err := fetchPeerState(context.Background(), &dd.peerClient, server.URL)
+	if err != nil {
+		t.Fatal("state should load from the peer: ", err.Error())
+	}
+	if am.Received != start.Unix() {
+		t.Error("receive time should be when the headers arrived, got ", am.Received-start.Unix())
+	}
+	dd.parseAlertData(am, sourcePeer)
+	if dd.alerts[a] != start.Unix()+300 {
+		t.Error("time reading the body should not be taken as clock skew, timeout moved by ", dd.alerts[a]-start.Unix()-300)
+	}
+	dd.cleanup()
+	peer.cleanup()
+}
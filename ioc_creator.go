@@ -57,6 +57,10 @@ func createDNSIOC(a Alert) *ind.IndicatorNode {
 		device := createDevNode(&a)
 		ioc.Children = append(ioc.Children, device)
 	}
+	if a.Network != "" {
+		network := createNetworkNode(&a)
+		ioc.Children = append(ioc.Children, network)
+	}
 	if sIp != nil {
 		ioc.Children = append(ioc.Children, sIp)
 	}
@@ -91,6 +95,10 @@ func createUserAgentIOC(a Alert) *ind.IndicatorNode {
 		device := createDevNode(&a)
 		ioc.Children = append(ioc.Children, device)
 	}
+	if a.Network != "" {
+		network := createNetworkNode(&a)
+		ioc.Children = append(ioc.Children, network)
+	}
 	if sIp != nil {
 		ioc.Children = append(ioc.Children, sIp)
 	}
@@ -121,6 +129,10 @@ func createIPsIOC(a Alert) *ind.IndicatorNode {
 		device := createDevNode(&a)
 		ioc.Children = append(ioc.Children, device)
 	}
+	if a.Network != "" {
+		network := createNetworkNode(&a)
+		ioc.Children = append(ioc.Children, network)
+	}
 
 	return &ioc
 }
@@ -153,13 +165,18 @@ func createBidirectIPsIOC(a Alert) *ind.IndicatorNode {
 		device := createDevNode(&a)
 		ioc.Children = append(ioc.Children, device)
 	}
+	if a.Network != "" {
+		network := createNetworkNode(&a)
+		ioc.Children = append(ioc.Children, network)
+	}
 
 	return &ioc
 }
 
 // this is a useful debugging function, pass it a root IOC node and indentation
 // (string of spaces), and it will return a sting representation of the entire
-// IOC tree showing the operator, patterns and children for each node
+// IOC tree showing the operator, patterns and children for each node. It is
+// also served by the /admin/iocs/<id>?format=text endpoint
 // example usage:
 //    log.Info("ioc created: " + printNode(ioc, ""))
 func printNode(n *ind.IndicatorNode, ident string) string {
@@ -246,3 +263,16 @@ func createDevNode(a *Alert) *ind.IndicatorNode {
 	}
 	return &device
 }
+
+// scopes an IOC to the network (tenant) the alert was raised from, so an
+// alert from one network is not applied to every other network's traffic
+func createNetworkNode(a *Alert) *ind.IndicatorNode {
+	network := ind.IndicatorNode{
+		ID: createID(),
+		Pattern: &ind.Pattern{
+			Type:  "network",
+			Value: a.Network,
+		},
+	}
+	return &network
+}
@@ -366,3 +366,68 @@ func TestBidirectIPsToIOC(t *testing.T) {
 		t.Error("have not seen all the child IOCs that were expected on a Bi directional IOC")
 	}
 }
+
+func TestNetworkScopedDnsTunnelToIOC(t *testing.T) {
+	dnsName := "blah.com"
+	device := "a-dev"
+	network := "vpn"
+
+	a := Alert{
+		Device:  device,
+		Network: network,
+		Type:    "dns",
+		Indicator: dt.Indicator{
+			Type:        "hostname",
+			Value:       dnsName,
+			Category:    "covert.dns-tunnel",
+			Probability: 0.9,
+			Id:          "b1769a6b-80c0-40e5-9287-a9a5d4262741",
+		},
+		TTL: 10,
+	}
+
+	ioc := convertAlertToIOC(a)
+
+	if ioc == nil {
+		t.Fatal("ioc returned is nil, ioc type must not be handled correctly")
+	}
+	if len(ioc.Children) != 3 {
+		t.Error("network scoped dns tunnel IOC should have 3 children, device, dns and network")
+	}
+
+	seenNetwork := false
+	for _, node := range ioc.Children {
+		if node.Pattern != nil && node.Pattern.Type == "network" {
+			seenNetwork = true
+			if node.Pattern.Value != network {
+				t.Error("network pattern on dns tunnel IOC should contain the network from the alert")
+			}
+		}
+	}
+	if !seenNetwork {
+		t.Error("alert with a network should create an IOC qualified by that network")
+	}
+}
+
+func TestUnscopedAlertHasNoNetworkNode(t *testing.T) {
+	a := Alert{
+		Device: "a-dev",
+		Type:   "dns",
+		Indicator: dt.Indicator{
+			Type:        "hostname",
+			Value:       "blah.com",
+			Category:    "covert.dns-tunnel",
+			Probability: 0.9,
+			Id:          "b1769a6b-80c0-40e5-9287-a9a5d4262741",
+		},
+		TTL: 10,
+	}
+
+	ioc := convertAlertToIOC(a)
+
+	for _, node := range ioc.Children {
+		if node.Pattern != nil && node.Pattern.Type == "network" {
+			t.Error("alert without a network should apply to all networks")
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	ind "github.com/trustnetworks/indicators"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// values from an event that IOC patterns match on, keyed by pattern type
+// e.g. "hostname", "src.ipv4", "dest.tcp", "device"
+type eventFields map[string][]string
+
+func (f eventFields) add(patternType, value string) {
+	if value != "" {
+		f[patternType] = append(f[patternType], value)
+	}
+}
+
+// the parts of an event IOCs match on, decoded from the event JSON
+type matchableEvent struct {
+	Time       string   `json:"time"`
+	Device     string   `json:"device"`
+	Network    string   `json:"network"`
+	Src        []string `json:"src"`
+	Dest       []string `json:"dest"`
+	DnsMessage *struct {
+		Query []struct {
+			Name string `json:"name"`
+		} `json:"query"`
+		Answer []struct {
+			Name string `json:"name"`
+		} `json:"answer"`
+	} `json:"dns_message"`
+	HttpRequest *struct {
+		Header map[string]string `json:"header"`
+	} `json:"http_request"`
+	Url string `json:"url"`
+}
+
+// extracts the values IOC patterns can match from an event
+func extractEventFields(event []byte) (eventFields, error) {
+	var ev matchableEvent
+	err := json.Unmarshal(event, &ev)
+	if err != nil {
+		return nil, err
+	}
+	return ev.fields(), nil
+}
+
+func (ev *matchableEvent) fields() eventFields {
+	f := make(eventFields)
+	f.add("device", ev.Device)
+	f.add("network", ev.Network)
+	for direction, addrs := range map[string][]string{"src": ev.Src, "dest": ev.Dest} {
+		for _, addr := range addrs {
+			parts := strings.SplitN(addr, ":", 2)
+			if len(parts) == 2 {
+				f.add(direction+"."+parts[0], parts[1])
+			}
+		}
+	}
+	if ev.DnsMessage != nil {
+		for _, q := range ev.DnsMessage.Query {
+			f.add("hostname", q.Name)
+		}
+		for _, a := range ev.DnsMessage.Answer {
+			f.add("hostname", a.Name)
+		}
+	}
+	if ev.HttpRequest != nil {
+		for k, v := range ev.HttpRequest.Header {
+			switch strings.ToLower(k) {
+			case "user-agent":
+				f.add("useragent", v)
+			case "host":
+				f.add("hostname", strings.Split(v, ":")[0])
+			}
+		}
+	}
+	if ev.Url != "" {
+		if u, err := url.Parse(ev.Url); err == nil {
+			f.add("hostname", u.Hostname())
+		}
+	}
+	return f
+}
+
+// the result of matching an IOC node against an event
+type NodeResult struct {
+	ID       string       `json:"id"`
+	Operator string       `json:"operator,omitempty"`
+	Pattern  *ind.Pattern `json:"pattern,omitempty"`
+	Matched  bool         `json:"matched"`
+	Children []NodeResult `json:"children,omitempty"`
+}
+
+func patternMatches(p *ind.Pattern, value string) bool {
+	switch p.Match {
+	case "dns":
+		value = strings.TrimSuffix(strings.ToLower(value), ".")
+		want := strings.TrimSuffix(strings.ToLower(p.Value), ".")
+		return value == want || strings.HasSuffix(value, "."+want)
+	case "int":
+		v, err1 := strconv.Atoi(value)
+		w, err2 := strconv.Atoi(p.Value)
+		return err1 == nil && err2 == nil && v == w
+	}
+	if strings.Contains(p.Value, "/") {
+		if _, network, err := net.ParseCIDR(p.Value); err == nil {
+			ip := net.ParseIP(value)
+			return ip != nil && network.Contains(ip)
+		}
+	}
+	return value == p.Value
+}
+
+// matches an IOC tree against an event and records the result of every node.
+// This approximates the detector library, it only knows the event fields
+// extractEventFields reads, so the result can differ from a lookup
+func matchNode(n *ind.IndicatorNode, f eventFields) NodeResult {
+	r := NodeResult{ID: n.ID, Operator: n.Operator, Pattern: n.Pattern}
+
+	switch n.Operator {
+	case "AND", "OR", "NOT":
+		r.Children = make([]NodeResult, 0, len(n.Children))
+		matched := 0
+		for _, c := range n.Children {
+			cr := matchNode(c, f)
+			if cr.Matched {
+				matched++
+			}
+			r.Children = append(r.Children, cr)
+		}
+		switch n.Operator {
+		case "AND":
+			r.Matched = len(n.Children) > 0 && matched == len(n.Children)
+		case "OR":
+			r.Matched = matched > 0
+		case "NOT":
+			r.Matched = matched == 0
+		}
+		return r
+	}
+
+	if n.Pattern != nil {
+		for _, v := range f[n.Pattern.Type] {
+			if patternMatches(n.Pattern, v) {
+				r.Matched = true
+				break
+			}
+		}
+	}
+	return r
+}
+
+// returns true if any pattern in the tree matched, including patterns under a
+// NOT, i.e. the event is related to the IOC even if it did not match it
+func (r NodeResult) anyPatternMatched() bool {
+	if r.Pattern != nil && r.Matched {
+		return true
+	}
+	for _, c := range r.Children {
+		if c.anyPatternMatched() {
+			return true
+		}
+	}
+	return false
+}
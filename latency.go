@@ -0,0 +1,75 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/worker"
+)
+
+// stages of handling an event that are timed
+const (
+	stageDecode = "decode"
+	stageLookup = "lookup"
+	stageEncode = "encode"
+	stageSend   = "send"
+)
+
+// time spent in each stage of the event path, the count of each histogram
+// gives the throughput. Times are taken from the wall clock, not dd.clock,
+// as they measure the detector rather than the events
+type eventLatency struct {
+	stageHistogram *prometheus.HistogramVec
+	// observer of each stage, only read after init so safe to share between
+	// workers
+	stages map[string]prometheus.Observer
+
+	alertsBacklogGauge *worker.Gauge
+}
+
+func (l *eventLatency) init() {
+	l.stageHistogram = registerHistogram(prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "event_stage_duration_seconds",
+			Help:    "time taken by each stage of handling an event",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}, []string{"analytic", "stage"},
+	))
+	l.stages = make(map[string]prometheus.Observer)
+	for _, stage := range []string{stageDecode, stageLookup, stageEncode, stageSend} {
+		l.stages[stage] = l.stageHistogram.WithLabelValues(pgm, stage)
+	}
+	l.alertsBacklogGauge = worker.CreateGauge(
+		worker.GaugeOpts{
+			Name: "alerts_backlog",
+			Help: "number of received alerts waiting to be loaded",
+		}, []string{"analytic"},
+	)
+}
+
+func (l *eventLatency) cleanup() {
+	prometheus.Unregister(l.stageHistogram)
+	worker.RemoveGauge(l.alertsBacklogGauge)
+}
+
+// records the time since start against a stage
+func (l *eventLatency) observe(stage string, start time.Time) {
+	l.stages[stage].Observe(time.Since(start).Seconds())
+}
+
+// registers a histogram, or returns the one already registered by an earlier
+// Init
+func registerHistogram(h *prometheus.HistogramVec) *prometheus.HistogramVec {
+	err := prometheus.Register(h)
+	if existing, ok := err.(prometheus.AlreadyRegisteredError); ok {
+		return existing.ExistingCollector.(*prometheus.HistogramVec)
+	}
+	return h
+}
+
+// sends an event, timing the send
+func (dd *dynamicDetector) send(w *worker.Worker, dest string, j *[]byte) {
+	start := time.Now()
+	Send(w, dest, j)
+	dd.latency.observe(stageSend, start)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	dt "github.com/trustnetworks/analytics-common/datatypes"
+	ind "github.com/trustnetworks/indicators"
+	"strings"
+)
+
+// index of the values loaded IOCs need an event to have, lets events that
+// cannot match any IOC skip the full decode and lookup. Each IOC is indexed
+// by a set of values at least one of which must be in an event for the IOC
+// to match, IOCs for which there is no such set (e.g. a NOT at the root or
+// a CIDR pattern) are counted as unconstrained and disable the prefilter
+type iocPrefilter struct {
+	keys          map[string]int
+	unconstrained int
+}
+
+func newIOCPrefilter() *iocPrefilter {
+	return &iocPrefilter{keys: make(map[string]int)}
+}
+
+func prefilterKey(patternType, value string) string {
+	if patternType == "hostname" {
+		value = strings.TrimSuffix(strings.ToLower(value), ".")
+	}
+	return patternType + ":" + value
+}
+
+// returns the values at least one of which an event must have to match the
+// node, false if the node can match without any particular value
+func requiredKeys(n *ind.IndicatorNode) ([]string, bool) {
+	switch n.Operator {
+	case "AND":
+		var best []string
+		constrained := false
+		for _, c := range n.Children {
+			keys, ok := requiredKeys(c)
+			if ok && (!constrained || len(keys) < len(best)) {
+				best = keys
+				constrained = true
+			}
+		}
+		return best, constrained
+	case "OR":
+		keys := make([]string, 0)
+		for _, c := range n.Children {
+			k, ok := requiredKeys(c)
+			if !ok {
+				return nil, false
+			}
+			keys = append(keys, k...)
+		}
+		return keys, true
+	case "NOT":
+		return nil, false
+	}
+	if n.Pattern == nil {
+		// matches nothing
+		return []string{}, true
+	}
+	switch {
+	case n.Pattern.Match == "dns" && n.Pattern.Type != "hostname",
+		n.Pattern.Match == "int",
+		strings.Contains(n.Pattern.Value, "/"):
+		return nil, false
+	}
+	return []string{prefilterKey(n.Pattern.Type, n.Pattern.Value)}, true
+}
+
+func (p *iocPrefilter) add(ioc *ind.IndicatorNode) {
+	if ioc == nil {
+		return
+	}
+	keys, ok := requiredKeys(ioc)
+	if !ok {
+		p.unconstrained++
+		return
+	}
+	for _, k := range keys {
+		p.keys[k]++
+	}
+}
+
+func (p *iocPrefilter) remove(ioc *ind.IndicatorNode) {
+	if ioc == nil {
+		return
+	}
+	keys, ok := requiredKeys(ioc)
+	if !ok {
+		p.unconstrained--
+		return
+	}
+	for _, k := range keys {
+		p.keys[k]--
+		if p.keys[k] <= 0 {
+			delete(p.keys, k)
+		}
+	}
+}
+
+// returns false if the event cannot match any loaded IOC. Hostname patterns
+// match subdomains so every suffix of an event hostname is checked
+func (p *iocPrefilter) mayMatch(f eventFields) bool {
+	if p.unconstrained > 0 {
+		return true
+	}
+	for patternType, values := range f {
+		for _, v := range values {
+			if patternType != "hostname" {
+				if p.keys[prefilterKey(patternType, v)] > 0 {
+					return true
+				}
+				continue
+			}
+			host := prefilterKey(patternType, v)[len("hostname:"):]
+			for {
+				if p.keys["hostname:"+host] > 0 {
+					return true
+				}
+				dot := strings.IndexByte(host, '.')
+				if dot < 0 {
+					break
+				}
+				host = host[dot+1:]
+			}
+		}
+	}
+	return false
+}
+
+// returns the start and end offsets of the value of a top-level field of a
+// JSON object, false if the object does not have the field
+func topLevelField(event []byte, name string) (int, int, bool, error) {
+	dec := json.NewDecoder(bytes.NewReader(event))
+	tok, err := dec.Token()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '{' {
+		return 0, 0, false, errors.New("event is not a JSON object")
+	}
+	for dec.More() {
+		tok, err = dec.Token()
+		if err != nil {
+			return 0, 0, false, err
+		}
+		var value json.RawMessage
+		err = dec.Decode(&value)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if tok == name {
+			end := int(dec.InputOffset())
+			return end - len(value), end, true, nil
+		}
+	}
+	return 0, 0, false, nil
+}
+
+// adds indicators to the event JSON without decoding and encoding the rest
+// of the event, so unknown fields and the order of fields are passed through
+// as they were received. Indicators the event already has are kept and the
+// new ones are added after them
+func spliceIndicators(event []byte, indicators []*dt.Indicator) ([]byte, error) {
+	start, end, found, err := topLevelField(event, "indicators")
+	if err != nil {
+		return nil, err
+	}
+	inds, err := json.Marshal(indicators)
+	if err != nil {
+		return nil, err
+	}
+
+	spliced := make([]byte, 0, len(event)+len(inds)+16)
+	if found {
+		existing := bytes.TrimSpace(event[start:end])
+		switch {
+		case bytes.Equal(existing, []byte("null")):
+			spliced = append(spliced, event[:start]...)
+			spliced = append(spliced, inds...)
+		case len(existing) >= 2 && existing[0] == '[':
+			// add the new elements after the last existing one
+			closing := start + bytes.LastIndexByte(event[start:end], ']')
+			last := start + 1 + len(bytes.TrimRight(event[start+1:closing], " \t\r\n"))
+			spliced = append(spliced, event[:last]...)
+			if last > start+1 {
+				spliced = append(spliced, ',')
+			}
+			spliced = append(spliced, inds[1:len(inds)-1]...)
+			spliced = append(spliced, event[last:end]...)
+		default:
+			return nil, errors.New("event indicators are not an array")
+		}
+		return append(spliced, event[end:]...), nil
+	}
+
+	trimmed := bytes.TrimRight(event, " \t\r\n")
+	opening := bytes.IndexByte(trimmed, '{')
+	closing := len(trimmed) - 1
+	empty := len(bytes.TrimSpace(trimmed[opening+1:closing])) == 0
+	spliced = append(spliced, trimmed[:closing]...)
+	if !empty {
+		spliced = append(spliced, ',')
+	}
+	spliced = append(spliced, `"indicators":`...)
+	spliced = append(spliced, inds...)
+	return append(spliced, '}'), nil
+}
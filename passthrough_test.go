@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	dt "github.com/trustnetworks/analytics-common/datatypes"
+	"github.com/trustnetworks/analytics-common/worker"
+	ind "github.com/trustnetworks/indicators"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestPrefilterRequiredKeys(t *testing.T) {
+	host := &ind.IndicatorNode{Pattern: &ind.Pattern{Type: "hostname", Value: "Blah.com.", Match: "dns"}}
+	device := &ind.IndicatorNode{Pattern: &ind.Pattern{Type: "device", Value: "a-dev"}}
+	network := &ind.IndicatorNode{Pattern: &ind.Pattern{Type: "src.ipv4", Value: "10.0.0.0/8"}}
+	not := &ind.IndicatorNode{Operator: "NOT", Children: []*ind.IndicatorNode{device}}
+
+	tests := []struct {
+		node        *ind.IndicatorNode
+		keys        int
+		constrained bool
+	}{
+		{host, 1, true},
+		{&ind.IndicatorNode{Operator: "AND", Children: []*ind.IndicatorNode{host, device}}, 1, true},
+		{&ind.IndicatorNode{Operator: "AND", Children: []*ind.IndicatorNode{network, not, host}}, 1, true},
+		{&ind.IndicatorNode{Operator: "OR", Children: []*ind.IndicatorNode{host, device}}, 2, true},
+		{&ind.IndicatorNode{Operator: "OR", Children: []*ind.IndicatorNode{host, network}}, 0, false},
+		{not, 0, false},
+	}
+	for i, test := range tests {
+		keys, ok := requiredKeys(test.node)
+		if ok != test.constrained || len(keys) != test.keys {
+			t.Error("wrong required keys for test ", i, ": ", keys, " ", ok)
+		}
+	}
+
+	p := newIOCPrefilter()
+	p.add(host)
+	p.add(host)
+	if !p.mayMatch(eventFields{"hostname": {"www.blah.com"}}) {
+		t.Error("subdomain of an IOC hostname may match")
+	}
+	if p.mayMatch(eventFields{"hostname": {"notblah.com"}, "device": {"a-dev"}}) {
+		t.Error("event without an IOC value cannot match")
+	}
+	p.remove(host)
+	if !p.mayMatch(eventFields{"hostname": {"blah.com"}}) {
+		t.Error("IOC values should be reference counted")
+	}
+	p.remove(host)
+	p.add(not)
+	if !p.mayMatch(eventFields{}) {
+		t.Error("unconstrained IOC should disable the prefilter")
+	}
+}
+
+func TestEventsWithoutHitsPassedThrough(t *testing.T) {
+	var dd dynamicDetector
+	dd.Init()
+	dd.prefilter = newIOCPrefilter()
+	dd.AddAlert(Alert{
+		Device: "theatregoing-mac",
+		Type:   "dns",
+		Indicator: dt.Indicator{
+			Type:        "hostname",
+			Value:       "blah.com",
+			Category:    "covert.dns-tunnel",
+			Probability: 0.9,
+			Id:          "b1769a6b-80c0-40e5-9287-a9a5d4262741",
+		},
+		TTL: 60,
+	})
+
+	var sent []byte
+	send := Send
+	defer func() { Send = send }()
+	Send = func(_ *worker.Worker, _ string, bs *[]byte) {
+		sent = *bs
+	}
+
+	hit := loadEventAsUint8sFromFile("test_data/single-dns-tunnel-event.json", t)
+	tests := map[string][]byte{
+		// rejected by the prefilter
+		"unrelated host": bytes.Replace(*hit, []byte("blah.com"), []byte("example.com"), -1),
+		// passes the prefilter but the IOC is for another device
+		"other device": bytes.Replace(*hit, []byte("theatregoing-mac"), []byte("another-dev"), 1),
+	}
+	for name, event := range tests {
+		sent = nil
+		dd.Handle(event, nil)
+		if !bytes.Equal(sent, event) {
+			t.Error("event without a hit should be sent unchanged: ", name)
+		}
+	}
+
+	dd.Handle(*hit, nil)
+	original := bytes.TrimRight(*hit, " \t\r\n")
+	if !bytes.HasPrefix(sent, original[:len(original)-1]) {
+		t.Error("indicators should be added without changing the rest of the event")
+	}
+	var ev dt.Event
+	err := json.Unmarshal(sent, &ev)
+	if err != nil {
+		t.Fatal("JSON unmarshal error: ", err.Error())
+	}
+	if ev.Indicators == nil || len(*ev.Indicators) != 1 || (*ev.Indicators)[0].Value != "blah.com" {
+		t.Error("event with a hit should have the indicator spliced in")
+	}
+	dd.cleanup()
+}
+
+func TestSpliceIndicators(t *testing.T) {
+	i := []*dt.Indicator{{Id: "x", Type: "hostname", Value: "blah.com", Probability: 1}}
+	spliced, err := spliceIndicators([]byte("{}\n"), i)
+	if err != nil || !bytes.HasPrefix(spliced, []byte(`{"indicators":[{`)) {
+		t.Error("indicators should be added to an empty event: ", string(spliced))
+	}
+	for _, event := range []string{" {}", "\n {\"id\": \"a\"} "} {
+		spliced, err = spliceIndicators([]byte(event), i)
+		if err != nil || !json.Valid(spliced) {
+			t.Error("indicators should be added to an event with leading whitespace: ", string(spliced))
+		}
+	}
+	tests := map[string]string{
+		`{"indicators": [], "id": "a"}`:        `{"indicators": [NEW], "id": "a"}`,
+		`{"indicators" : null}`:                `{"indicators" : [NEW]}`,
+		`{"indicators":[ {"id":"y"} ] ,"z":1}`: `{"indicators":[ {"id":"y"},NEW ] ,"z":1}`,
+	}
+	added, _ := json.Marshal(i[0])
+	for event, want := range tests {
+		want = strings.Replace(want, "NEW", string(added), 1)
+		spliced, err = spliceIndicators([]byte(event), i)
+		if err != nil || string(spliced) != want {
+			t.Error("new indicators should be added to existing ones, got ", string(spliced), " want ", want)
+		}
+	}
+	_, err = spliceIndicators([]byte(`{"indicators": "x"}`), i)
+	if err == nil {
+		t.Error("indicators which are not an array should not be spliced")
+	}
+	_, err = spliceIndicators([]byte(`["not", "an", "object"]`), i)
+	if err == nil {
+		t.Error("events which are not objects should not be spliced")
+	}
+}
+
+func TestEnrichmentKeepsUnknownFields(t *testing.T) {
+	var dd dynamicDetector
+	dd.Init()
+	a := Alert{
+		Device: "theatregoing-mac",
+		Type:   "dns",
+		Indicator: dt.Indicator{
+			Type:        "hostname",
+			Value:       "blah.com",
+			Category:    "covert.dns-tunnel",
+			Probability: 0.9,
+			Id:          "b1769a6b-80c0-40e5-9287-a9a5d4262741",
+		},
+		TTL: 60,
+	}
+	dd.AddAlert(a)
+
+	var sent []byte
+	send := Send
+	defer func() { Send = send }()
+	Send = func(_ *worker.Worker, _ string, bs *[]byte) {
+		sent = *bs
+	}
+	event := loadEventAsUint8sFromFile("test_data/unknown-fields-event.json", t)
+	dd.Handle(*event, nil)
+
+	// the output is the input with the indicator added after the existing one
+	added, _ := json.Marshal(&a.Indicator)
+	existingEnd := bytes.Index(*event, []byte("\n  ],\n  \"dns_message\""))
+	if existingEnd < 0 {
+		t.Fatal("test event has changed")
+	}
+	want := make([]byte, 0)
+	want = append(want, (*event)[:existingEnd]...)
+	want = append(want, ',')
+	want = append(want, added...)
+	want = append(want, (*event)[existingEnd:]...)
+	if !bytes.Equal(sent, want) {
+		t.Error("event should be unchanged apart from the added indicator, got ", string(sent))
+	}
+	dd.cleanup()
+}
+
+// the prefilter must never reject an event the detector library matches, for
+// every kind of IOC the dynamic detector creates
+func TestPrefilterAgreesWithLookup(t *testing.T) {
+	indicator := dt.Indicator{
+		Type:        "hostname",
+		Value:       "blah.com",
+		Category:    "covert.dns-tunnel",
+		Probability: 0.9,
+		Id:          "b1769a6b-80c0-40e5-9287-a9a5d4262741",
+	}
+	comms := func(alertType string, src, dest CommsInfo) Alert {
+		i := indicator
+		i.Type = "ipv4"
+		i.Value = "8.8.8.8"
+		return Alert{Type: alertType, Device: "a-dev", Src: src, Dest: dest, Indicator: i, TTL: 60}
+	}
+	ua := indicator
+	ua.Type = "useragent"
+	ua.Value = "evil-agent/1.0"
+
+	tests := []struct {
+		name  string
+		alert Alert
+		event string
+	}{
+		{"dns query", Alert{Type: "dns", Device: "a-dev", Indicator: indicator, TTL: 60},
+			`{"device":"a-dev","dns_message":{"query":[{"name":"blah.com"}]}}`},
+		{"dns subdomain", Alert{Type: "dns", Device: "a-dev", Indicator: indicator, TTL: 60},
+			`{"device":"a-dev","dns_message":{"query":[{"name":"www.blah.com"}]}}`},
+		{"dns with network scope", Alert{Type: "dns", Device: "a-dev", Network: "vpn", Indicator: indicator, TTL: 60},
+			`{"device":"a-dev","network":"vpn","dns_message":{"query":[{"name":"blah.com"}]}}`},
+		{"dns with IPs", Alert{Type: "dns", Device: "a-dev", Indicator: indicator, TTL: 60,
+			Src: CommsInfo{IP: "ipv4:10.0.0.1"}, Dest: CommsInfo{IP: "ipv4:8.8.8.8"}},
+			`{"device":"a-dev","src":["ipv4:10.0.0.1"],"dest":["ipv4:8.8.8.8"],"dns_message":{"query":[{"name":"blah.com"}]}}`},
+		{"useragent", Alert{Type: "useragent", Device: "a-dev", Indicator: ua, TTL: 60},
+			`{"device":"a-dev","http_request":{"header":{"User-Agent":"evil-agent/1.0"}}}`},
+		{"ip comms", comms("ip-comms", CommsInfo{IP: "ipv4:10.0.0.1"}, CommsInfo{IP: "ipv4:8.8.8.8"}),
+			`{"device":"a-dev","src":["ipv4:10.0.0.1"],"dest":["ipv4:8.8.8.8"]}`},
+		{"bidirectional ip comms", comms("bidirect-ip-comms", CommsInfo{IP: "ipv4:10.0.0.1"}, CommsInfo{IP: "ipv4:8.8.8.8"}),
+			`{"device":"a-dev","src":["ipv4:8.8.8.8"],"dest":["ipv4:10.0.0.1"]}`},
+		{"bidirectional ip comms with ports", comms("bidirect-ip-comms",
+			CommsInfo{IP: "ipv4:10.0.0.1", Port: 5353, Proto: "udp"}, CommsInfo{IP: "ipv4:8.8.8.8", Port: 53, Proto: "udp"}),
+			`{"device":"a-dev","src":["ipv4:10.0.0.1","udp:5353"],"dest":["ipv4:8.8.8.8","udp:53"]}`},
+	}
+	for _, test := range tests {
+		var dd dynamicDetector
+		dd.Init()
+		dd.prefilter = newIOCPrefilter()
+		dd.AddAlert(test.alert)
+
+		var ev dt.Event
+		err := json.Unmarshal([]byte(test.event), &ev)
+		if err != nil {
+			t.Fatal("JSON unmarshal error: ", err.Error())
+		}
+		if len(dd.detectorLib.Lookup(&ev)) == 0 {
+			t.Error("test event should match the IOC: ", test.name)
+		}
+		f, err := extractEventFields([]byte(test.event))
+		if err != nil {
+			t.Fatal("JSON unmarshal error: ", err.Error())
+		}
+		if !dd.prefilter.mayMatch(f) {
+			t.Error("prefilter rejected an event the detector matches: ", test.name)
+		}
+		dd.cleanup()
+	}
+}
+
+// events for the benchmarks, one in ten has a hit
+func benchmarkEvents(b *testing.B) [][]byte {
+	hit, err := ioutil.ReadFile("test_data/single-dns-tunnel-event.json")
+	if err != nil {
+		b.Fatal(err)
+	}
+	miss := bytes.Replace(hit, []byte("blah.com"), []byte("example.com"), -1)
+	events := make([][]byte, 10)
+	for i := range events {
+		events[i] = miss
+	}
+	events[0] = hit
+	return events
+}
+
+func benchmarkDetector(prefilter bool) *dynamicDetector {
+	var dd dynamicDetector
+	dd.Init()
+	if prefilter {
+		dd.prefilter = newIOCPrefilter()
+	}
+	dd.AddAlert(Alert{
+		Device: "theatregoing-mac",
+		Type:   "dns",
+		Indicator: dt.Indicator{
+			Type:        "hostname",
+			Value:       "blah.com",
+			Category:    "covert.dns-tunnel",
+			Probability: 0.9,
+			Id:          "b1769a6b-80c0-40e5-9287-a9a5d4262741",
+		},
+		TTL: 60,
+	})
+	return &dd
+}
+
+// every event decoded, looked up and encoded again
+func BenchmarkHandleReencoded(b *testing.B) {
+	dd := benchmarkDetector(false)
+	send := Send
+	defer func() { Send = send }()
+	Send = func(_ *worker.Worker, _ string, _ *[]byte) {}
+	events := benchmarkEvents(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var ev dt.Event
+		err := json.Unmarshal(events[i%len(events)], &ev)
+		if err != nil {
+			b.Fatal(err)
+		}
+		dd.handleEventWith(dd.liveView(), &ev)
+		j, err := json.Marshal(ev)
+		if err != nil {
+			b.Fatal(err)
+		}
+		Send(nil, "output", &j)
+	}
+	b.StopTimer()
+	dd.cleanup()
+}
+
+func benchmarkHandle(b *testing.B, prefilter bool) {
+	dd := benchmarkDetector(prefilter)
+	send := Send
+	defer func() { Send = send }()
+	Send = func(_ *worker.Worker, _ string, _ *[]byte) {}
+	events := benchmarkEvents(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dd.Handle(events[i%len(events)], nil)
+	}
+	b.StopTimer()
+	dd.cleanup()
+}
+
+// events without a hit sent as they were received
+func BenchmarkHandlePassThrough(b *testing.B) {
+	benchmarkHandle(b, false)
+}
+
+// events without a hit also skip the full decode and lookup
+func BenchmarkHandlePrefiltered(b *testing.B) {
+	benchmarkHandle(b, true)
+}
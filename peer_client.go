@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/trustnetworks/analytics-common/utils"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// client for requests to the alert servers of other dynamic detectors,
+// presenting the shared token and client certificate if configured
+type peerClient struct {
+	client *http.Client
+	token  string
+	// scheme of peer URLs found through discovery
+	scheme string
+	clock  Clock
+}
+
+func (pc *peerClient) init() {
+	pc.client = &http.Client{}
+	if pc.clock == nil {
+		pc.clock = realClock{}
+	}
+	pc.token = utils.Getenv("ALERT_SERVER_TOKEN", "")
+	pc.scheme = "http"
+
+	caFile := utils.Getenv("PEER_TLS_CA", "")
+	certFile := utils.Getenv("PEER_TLS_CERT", "")
+	keyFile := utils.Getenv("PEER_TLS_KEY", "")
+	if caFile == "" && certFile == "" {
+		return
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			log.Fatal("Couldn't load PEER_TLS_CA: ", err.Error())
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			log.Fatal("Couldn't load PEER_TLS_CERT and PEER_TLS_KEY: ", err.Error())
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	pc.client.Transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: config,
+	}
+	pc.scheme = "https"
+}
+
+// the alert server of the other dynamic detectors in the namespace, with the
+// scheme the client is set up for
+func (pc *peerClient) defaultPeerURL() string {
+	return pc.scheme + "://dynamicdetector:8081"
+}
+
+// returns an error if TLS is set up for peers but the URL would send
+// requests, and the token, in plain text
+func (pc *peerClient) checkURL(url string) error {
+	if pc.scheme == "https" && !strings.HasPrefix(url, "https://") {
+		return errors.New("peer URL " + url + " is not https but PEER_TLS_CA or PEER_TLS_CERT is set")
+	}
+	return nil
+}
+
+func (pc *peerClient) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if pc.token != "" {
+		req.Header.Set("Authorization", "Bearer "+pc.token)
+	}
+	return pc.client.Do(req.WithContext(ctx))
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + file)
+	}
+	return pool, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/trustnetworks/analytics-common/worker"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// interval between heartbeats on an idle stream
+	streamHeartbeatInterval = 30 * time.Second
+	// a stream with nothing received for this long is considered dead
+	streamIdleTimeout = 3 * streamHeartbeatInterval
+	// response header with the hostname of the dynamic detector streaming
+	replicaHeader = "X-Dynamic-Detector-Replica"
+)
+
+// name of this dynamic detector replica
+func localHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		// been unable to get hostname. Use random number instead
+		hostname = uuid.New().String()
+	}
+	return hostname
+}
+
+// streams alert state changes from another dynamic detector, reconnecting and
+// resuming from the last change seen if the stream is lost. The peer URL can
+// resolve to this replica, hostname is used to detect that and try again
+func streamFromPeer(ctx context.Context, pc *peerClient, peerURL, hostname string) <-chan AlertChange {
+	ch := make(chan AlertChange, 100)
+	go func() {
+		var feed string
+		var seq uint64
+		backoff := time.Second
+		for {
+			err := readPeerStream(ctx, pc, peerURL, hostname, &feed, &seq, ch)
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			if err == nil {
+				backoff = time.Second
+			} else {
+				log.Warn("alert stream from ", peerURL, " lost: ", err.Error())
+			}
+			pc.clock.Sleep(backoff)
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+		}
+	}()
+	return ch
+}
+
+// reads one stream connection, passing every change on to ch and keeping
+// track of the feed and sequence number to resume from
+func readPeerStream(ctx context.Context, pc *peerClient, peerURL, hostname string, feed *string, seq *uint64, ch chan<- AlertChange) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	url := peerURL + "/alerts/stream?feed=" + *feed + "&since=" + strconv.FormatUint(*seq, 10)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := pc.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("unexpected status " + resp.Status)
+	}
+	if resp.Header.Get(replicaHeader) == hostname {
+		return errors.New("peer is this dynamic detector")
+	}
+	log.Info("streaming alert changes from ", peerURL)
+
+	// cancel the request if the peer goes quiet, heartbeats are expected
+	idle := pc.clock.AfterFunc(streamIdleTimeout, cancel)
+	defer idle.Stop()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var c AlertChange
+		err := dec.Decode(&c)
+		if err != nil {
+			return err
+		}
+		idle.Reset(streamIdleTimeout)
+
+		if c.Feed != *feed {
+			// new feed (peer restarted or a different peer) starts again
+			// with a snapshot
+			*feed = c.Feed
+		}
+		*seq = c.Seq
+		select {
+		case ch <- c:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// applies a change from another dynamic detector, returning true if the
+// alert state changed. Alerts are only ever extended by a peer, so changes
+// echoed between peers settle
+func (dd *dynamicDetector) applyPeerChange(c AlertChange, source string) bool {
+	skew := dd.clockSkew(c.Now)
+
+	switch c.Op {
+	case changeSynced, changeHeartbeat:
+		dd.warnClockSkew(skew)
+	case changeSnapshot, changeAdd, changeExtend:
+		if c.Alert == nil {
+			return false
+		}
+		timeout := c.Timeout + skew
+		validFrom := c.ValidFrom
+		if validFrom != 0 {
+			validFrom += skew
+		}
+		dd.lock.RLock()
+		existing, ok := dd.alerts[*c.Alert]
+		dd.lock.RUnlock()
+		if !ok || existing < timeout {
+			dd.AddExistingAlertFrom(*c.Alert, validFrom, timeout, source)
+			// the timeout may have been limited to the alert's TTL
+			dd.lock.RLock()
+			defer dd.lock.RUnlock()
+			return dd.alerts[*c.Alert] > existing
+		}
+	case changeRevoke:
+		if c.Alert == nil {
+			return false
+		}
+		return dd.RevokeAlert(*c.Alert, source)
+	}
+	// expiry is left to the local timeout so that clock skew between peers
+	// does not remove alerts early, and evictions to the local alert limits
+	return false
+}
+
+// removes an alert before it has expired, returns false if the alert was not
+// stored
+func (dd *dynamicDetector) RevokeAlert(a Alert, source string) bool {
+	dd.lock.Lock()
+	defer dd.lock.Unlock()
+
+	timeout, ok := dd.alerts[a]
+	if !ok {
+		return false
+	}
+	log.Info("revoking ", a.Type, " alert for ", a.Indicator.Value)
+	validFrom := dd.validFrom[a]
+	dd.removeAlert(a, alertRevoked, source)
+	dd.changes.publish(changeRevoke, a, validFrom, timeout)
+	dd.alertDBSizeGauge.Set(float64(len(dd.alerts)), worker.MetricLabels{"analytic": pgm})
+	return true
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	dt "github.com/trustnetworks/analytics-common/datatypes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testSyncAlert() Alert {
+	return Alert{
+		Device: "a-dev",
+		Type:   "dns",
+		Indicator: dt.Indicator{
+			Type:        "hostname",
+			Value:       "blah.com",
+			Category:    "covert.dns-tunnel",
+			Probability: 0.9,
+			Id:          "b1769a6b-80c0-40e5-9287-a9a5d4262741",
+		},
+		TTL: 60,
+	}
+}
+
+func TestChangeFeedResume(t *testing.T) {
+	var f changeFeed
+	f.init(realClock{})
+	a := testSyncAlert()
+
+	f.publish(changeAdd, a, 0, 100)
+	f.publish(changeExtend, a, 0, 200)
+
+	ch, backlog, seq, resumed := f.subscribe(f.id, 1)
+	if !resumed {
+		t.Fatal("should be able to resume from a change still in the history")
+	}
+	if len(backlog) != 1 || backlog[0].Op != changeExtend || seq != 2 {
+		t.Error("resuming should return only the changes missed")
+	}
+	f.unsubscribe(ch)
+
+	ch, _, _, resumed = f.subscribe("another-feed", 1)
+	if resumed {
+		t.Error("should not resume from a sequence number of a different feed")
+	}
+
+	f.publish(changeExpire, a, 0, 200)
+	select {
+	case c := <-ch:
+		if c.Op != changeExpire || c.Seq != 3 || c.Key != a.Key() {
+			t.Error("subscriber received wrong change: ", c)
+		}
+	default:
+		t.Error("subscriber should receive published changes")
+	}
+	f.unsubscribe(ch)
+}
+
+func TestPeerChangesOnlyExtendAlerts(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+
+	now := clock.Now()
+	a := testSyncAlert()
+	a.TTL = 300
+	dd.AddExistingAlert(a, now.Unix()+100)
+
+	dd.applyPeerChange(AlertChange{Op: changeExtend, Alert: &a, Timeout: now.Unix() + 50, Now: now.Unix()}, sourcePeer)
+	if dd.alerts[a] != now.Unix()+100 {
+		t.Error("peer change should not shorten an alert")
+	}
+
+	// peer clock 10 seconds behind
+	dd.applyPeerChange(AlertChange{Op: changeExtend, Alert: &a, Timeout: now.Unix() + 140, Now: now.Unix() - 10}, sourcePeer)
+	if dd.alerts[a] != now.Unix()+150 {
+		t.Error("peer change should extend alert, corrected for clock skew")
+	}
+
+	// a peer can not extend an alert past its TTL
+	if !dd.applyPeerChange(AlertChange{Op: changeExtend, Alert: &a, Timeout: now.Unix() + 86400, Now: now.Unix()}, sourcePeer) {
+		t.Error("peer change up to the alert's TTL should be applied")
+	}
+	if dd.alerts[a] != now.Unix()+300 {
+		t.Error("peer change should be limited to the alert's TTL, got ", dd.alerts[a]-now.Unix())
+	}
+
+	dd.applyPeerChange(AlertChange{Op: changeExpire, Alert: &a, Timeout: now.Unix() + 150, Now: now.Unix()}, sourcePeer)
+	if len(dd.alerts) != 1 {
+		t.Error("alerts should be expired by the local timeout not a peer")
+	}
+
+	dd.applyPeerChange(AlertChange{Op: changeRevoke, Alert: &a, Now: now.Unix()}, sourcePeer)
+	if len(dd.alerts) != 0 || dd.detectorLib.GetNumberOfNodes() != 0 {
+		t.Error("revoked alert should be removed along with its IOC")
+	}
+	dd.cleanup()
+}
+
+func TestStreamSyncBetweenDetectors(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	now := clock.Now()
+
+	var peer dynamicDetector
+	peer.clock = clock
+	peer.Init()
+	peer.hostname = "peer"
+	a := testSyncAlert()
+	peer.AddAlert(a)
+
+	var as alertServer
+	as.dd = &peer
+	mux := http.NewServeMux()
+	mux.HandleFunc("/alerts/stream", as.handleStream)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := streamFromPeer(ctx, &dd.peerClient, server.URL, dd.hostname)
+
+	next := func() AlertChange {
+		select {
+		case c := <-changes:
+			dd.applyPeerChange(c, sourcePeer)
+			return c
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for alert change from peer")
+		}
+		return AlertChange{}
+	}
+
+	if c := next(); c.Op != changeSnapshot {
+		t.Error("stream should start with a snapshot, got ", c.Op)
+	}
+	if c := next(); c.Op != changeSynced {
+		t.Error("snapshot should be followed by synced marker, got ", c.Op)
+	}
+	if dd.alerts[a] != now.Unix()+a.TTL {
+		t.Error("snapshot should load the peer's alerts")
+	}
+
+	a2 := a
+	a2.Indicator.Value = "a.tunnel.com"
+	peer.AddAlert(a2)
+	if c := next(); c.Op != changeAdd {
+		t.Error("live changes should follow the snapshot, got ", c.Op)
+	}
+	if _, ok := dd.alerts[a2]; !ok {
+		t.Error("alert added on peer should be added from the stream")
+	}
+	dd.cleanup()
+	peer.cleanup()
+}
+
+func TestRevokeThroughAlertServerReachesPeers(t *testing.T) {
+	clock := newFakeClock(time.Now())
+
+	var peer dynamicDetector
+	peer.clock = clock
+	peer.Init()
+	peer.hostname = "peer"
+	a := testSyncAlert()
+	peer.AddAlert(a)
+
+	var as alertServer
+	as.dd = &peer
+	as.token = "a-secret"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/alerts/", as.authenticated(as.handleAlert))
+	mux.HandleFunc("/alerts/stream", as.authenticated(as.handleStream))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+	dd.peerClient.token = "a-secret"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := streamFromPeer(ctx, &dd.peerClient, server.URL, dd.hostname)
+	next := func() AlertChange {
+		select {
+		case c := <-changes:
+			dd.applyPeerChange(c, sourcePeer)
+			return c
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for alert change from peer")
+		}
+		return AlertChange{}
+	}
+	for c := next(); c.Op != changeSynced; c = next() {
+	}
+	if _, ok := dd.alerts[a]; !ok {
+		t.Fatal("alert should be loaded from the peer")
+	}
+
+	revoke := func(token string) int {
+		req, _ := http.NewRequest("DELETE", server.URL+"/alerts/"+a.Key(), nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("revoke request failed: ", err.Error())
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := revoke(""); code != 401 {
+		t.Error("revoke without the token should be rejected, got ", code)
+	}
+	if code := revoke("a-secret"); code != 204 {
+		t.Error("revoke with the token should succeed, got ", code)
+	}
+	if _, ok := peer.alerts[a]; ok {
+		t.Error("revoked alert should be removed from the replica that was called")
+	}
+	if c := next(); c.Op != changeRevoke {
+		t.Error("revoke should be streamed to peers, got ", c.Op)
+	}
+	if _, ok := dd.alerts[a]; ok || dd.detectorLib.GetNumberOfNodes() != 0 {
+		t.Error("revoked alert should be removed from peers along with its IOC")
+	}
+	if code := revoke("a-secret"); code != 404 {
+		t.Error("revoking an alert that isn't stored should give 404, got ", code)
+	}
+	dd.cleanup()
+	peer.cleanup()
+}
+
+// waits, on the wall clock, for the condition to hold
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for ", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStreamReconnectBackoffUsesClock(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	clock := newFakeClock(time.Now())
+	var pc peerClient
+	pc.clock = clock
+	pc.init()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	streamFromPeer(ctx, &pc, server.URL, "me")
+
+	sleeping := func() bool { return clock.Waiters() == 1 }
+	waitFor(t, "first attempt", sleeping)
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatal("expected 1 attempt before the clock moves, got ", n)
+	}
+	clock.Advance(time.Second)
+	waitFor(t, "second attempt", func() bool { return atomic.LoadInt32(&requests) == 2 && sleeping() })
+
+	// backoff has doubled
+	clock.Advance(time.Second)
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Error("should wait out the doubled backoff, got ", n, " attempts")
+	}
+	clock.Advance(time.Second)
+	waitFor(t, "third attempt", func() bool { return atomic.LoadInt32(&requests) == 3 })
+}
+
+func TestQuietStreamTimesOutOnClock(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		// never sends a heartbeat
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	clock := newFakeClock(time.Now())
+	var pc peerClient
+	pc.clock = clock
+	pc.init()
+	var feed string
+	var seq uint64
+	done := make(chan error, 1)
+	go func() {
+		done <- readPeerStream(context.Background(), &pc, server.URL, "me", &feed, &seq, make(chan AlertChange))
+	}()
+
+	waitFor(t, "stream to start", func() bool { return clock.Waiters() == 1 })
+	clock.Advance(streamIdleTimeout - time.Second)
+	select {
+	case err := <-done:
+		t.Fatal("stream should not time out before the idle timeout: ", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("timed out stream should return an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("quiet stream should be cancelled after the idle timeout")
+	}
+}
+
+func TestEvictionsNotAppliedByPeers(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+	dd.limits.maxAlerts = 1
+	dd.limits.eviction = evictSoonestExpiring
+	var peer dynamicDetector
+	peer.clock = clock
+	peer.Init()
+
+	ch, _, _, _ := dd.changes.subscribe("", 0)
+	a := testSyncAlert()
+	b := testSyncAlert()
+	b.Device = "b-dev"
+	b.TTL = 120
+	dd.AddAlert(a)
+	peer.AddAlert(a)
+	dd.AddAlert(b)
+
+	evicted := false
+	for len(ch) > 0 {
+		c := <-ch
+		if c.Op == changeRevoke {
+			t.Error("eviction should not be published as a revoke")
+		}
+		if c.Op == changeEvict {
+			evicted = true
+			peer.applyPeerChange(c, sourcePeer)
+		}
+	}
+	if !evicted {
+		t.Error("eviction should be published")
+	}
+	if _, ok := peer.alerts[a]; !ok {
+		t.Error("alert evicted by another replica should be kept")
+	}
+	dd.changes.unsubscribe(ch)
+	dd.cleanup()
+	peer.cleanup()
+}
+
+func TestStreamFromSelfSkipped(t *testing.T) {
+	var dd dynamicDetector
+	dd.Init()
+	var as alertServer
+	as.dd = &dd
+	mux := http.NewServeMux()
+	mux.HandleFunc("/alerts/stream", as.handleStream)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var feed string
+	var seq uint64
+	ch := make(chan AlertChange, 1)
+	err := readPeerStream(ctx, &dd.peerClient, server.URL, dd.hostname, &feed, &seq, ch)
+	if err == nil || len(ch) != 0 {
+		t.Error("changes should not be streamed from this dynamic detector")
+	}
+	dd.cleanup()
+}
+
+func TestPeerChangesAppliedWithoutEvents(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+	changes := make(chan AlertChange, 1)
+	dd.peerChanges = changes
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		dd.updateStatePeriodically(ctx, cancel)
+		close(done)
+	}()
+
+	a := testSyncAlert()
+	now := clock.Now().Unix()
+	changes <- AlertChange{Op: changeAdd, Alert: &a, Timeout: now + 60, Now: now}
+	// wait for the update ticker, the expiry timer is also waiting
+	for clock.Waiters() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(stateUpdateInterval)
+	for i := 0; i < 1000 && len(changes) > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+	if _, ok := dd.alerts[a]; !ok {
+		t.Error("peer change should be applied when there are no events")
+	}
+	dd.cleanup()
+}
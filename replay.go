@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	dt "github.com/trustnetworks/analytics-common/datatypes"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// hits for an alert during a replay
+type ReplayAlertHits struct {
+	Key   string `json:"key"`
+	Alert Alert  `json:"alert"`
+	Hits  int    `json:"hits"`
+	// IDs of the first events matched
+	Events []string `json:"events"`
+}
+
+type ReplayReport struct {
+	Events        int               `json:"events"`
+	Unreadable    int               `json:"unreadable"`
+	EventsMatched int               `json:"events_matched"`
+	Seconds       float64           `json:"seconds"`
+	EventsPerSec  float64           `json:"events_per_second"`
+	Alerts        []ReplayAlertHits `json:"alerts"`
+}
+
+// replays recorded events through the detector with a set of alerts loaded,
+// without needing AMQP. Usage:
+//
+//	dynamic-detector replay -alerts alerts.json events.ndjson[.gz] ...
+func replay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	alertsFile := flags.String("alerts", "", "file of alerts to load, in the /alerts JSON format")
+	maxEvents := flags.Int("matches", 10, "number of matched event IDs to report per alert")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if *alertsFile == "" || flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: dynamic-detector replay -alerts <file> <events file>...")
+		return 2
+	}
+
+	var am AlertsMessage
+	err = readJSONFile(*alertsFile, &am)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "couldn't read alerts: ", err.Error())
+		return 1
+	}
+
+	var r replayer
+	r.init(am, *maxEvents)
+	defer r.dd.cleanup()
+	for _, file := range flags.Args() {
+		err = r.replayFile(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "couldn't replay ", file, ": ", err.Error())
+			return 1
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(r.report())
+	return 0
+}
+
+type replayer struct {
+	dd        dynamicDetector
+	alerts    AlertsMessage
+	maxEvents int
+
+	// follows the time on the events, starting at the first one
+	clock  *fakeClock
+	loaded bool
+
+	start time.Time
+	stats ReplayReport
+	hits  map[Alert]*ReplayAlertHits
+}
+
+func (r *replayer) init(am AlertsMessage, maxEvents int) {
+	r.alerts = am
+	r.maxEvents = maxEvents
+	r.hits = make(map[Alert]*ReplayAlertHits)
+	r.clock = newFakeClock(time.Time{})
+	r.dd.clock = r.clock
+	r.dd.Init()
+	// the report is written to stdout, so nothing else is written from the
+	// replay
+	r.dd.audits.dest = ""
+	r.dd.retro.window = 0
+	r.start = time.Now()
+}
+
+// loads the alerts at the time of the first event. Alerts without a timeout
+// are active for their TTL from then, alerts with a timeout are shifted by
+// the difference between the first event and when the alerts were saved
+func (r *replayer) loadAlerts() {
+	existing := AlertsMessage{Now: r.alerts.Now}
+	for _, ad := range r.alerts.Alerts {
+		if ad.Timeout == 0 {
+			r.dd.addAlert(ad.Alert, sourceReplay)
+		} else {
+			existing.Alerts = append(existing.Alerts, ad)
+		}
+	}
+	r.dd.parseAlertData(existing, sourceReplay)
+	r.loaded = true
+}
+
+// moves the replay clock on to the event time, alerts are timed out by the
+// detector as the clock passes its timer. Alerts are loaded at the time of
+// the first event, or the current time if it has none
+func (r *replayer) advanceClock(eventTime string) {
+	t, err := time.Parse(time.RFC3339Nano, eventTime)
+	if !r.loaded {
+		if err != nil {
+			t = time.Now()
+		}
+		r.clock.Set(t)
+		r.loadAlerts()
+		return
+	}
+	if err == nil {
+		r.clock.Set(t)
+	}
+}
+
+func (r *replayer) replayEvent(msg []byte) {
+	r.stats.Events++
+	var ev dt.Event
+	err := json.Unmarshal(msg, &ev)
+	if err != nil {
+		r.stats.Unreadable++
+		return
+	}
+	r.advanceClock(ev.Time)
+	r.dd.updateState()
+
+	matched := r.dd.handleEvent(&ev)
+	if len(matched) == 0 {
+		return
+	}
+	r.stats.EventsMatched++
+
+	for _, a := range matched {
+		h, ok := r.hits[a]
+		if !ok {
+			h = &ReplayAlertHits{Key: a.Key(), Alert: a, Events: make([]string, 0)}
+			r.hits[a] = h
+		}
+		h.Hits++
+		if len(h.Events) < r.maxEvents {
+			h.Events = append(h.Events, ev.Id)
+		}
+	}
+}
+
+// replays newline delimited events from a file, which may be gzipped. A file
+// name of - reads from stdin
+func (r *replayer) replayFile(file string) error {
+	var in io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	if strings.HasSuffix(file, ".gz") {
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		in = gz
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		r.replayEvent(line)
+	}
+	return scanner.Err()
+}
+
+func (r *replayer) report() ReplayReport {
+	report := r.stats
+	report.Seconds = time.Since(r.start).Seconds()
+	if report.Seconds > 0 {
+		report.EventsPerSec = float64(report.Events) / report.Seconds
+	}
+	report.Alerts = make([]ReplayAlertHits, 0, len(r.hits))
+	for _, h := range r.hits {
+		report.Alerts = append(report.Alerts, *h)
+	}
+	sort.Slice(report.Alerts, func(i, j int) bool {
+		if report.Alerts[i].Hits != report.Alerts[j].Hits {
+			return report.Alerts[i].Hits > report.Alerts[j].Hits
+		}
+		return report.Alerts[i].Key < report.Alerts[j].Key
+	})
+	return report
+}
+
+func readJSONFile(file string, v interface{}) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(v)
+	if err != nil {
+		return errors.New("couldn't decode " + file + ": " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	dt "github.com/trustnetworks/analytics-common/datatypes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplayFollowsEventTime(t *testing.T) {
+
+	a := Alert{
+		Device: "theatregoing-mac",
+		Type:   "dns",
+		Indicator: dt.Indicator{
+			Type:        "hostname",
+			Value:       "blah.com",
+			Category:    "covert.dns-tunnel",
+			Probability: 0.9,
+			Id:          "b1769a6b-80c0-40e5-9287-a9a5d4262741",
+		},
+		TTL: 10,
+	}
+	otherDevice := a
+	otherDevice.Device = "another-dev"
+
+	event := loadEventAsUint8sFromFile("test_data/single-dns-tunnel-event.json", t)
+	var compact bytes.Buffer
+	err := json.Compact(&compact, *event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := compact.Bytes()
+	// Within the alert's TTL of the first event
+	second := bytes.Replace(first, []byte("2018-03-29T11:34:13.537Z"), []byte("2018-03-29T11:34:18.537Z"), 1)
+	// After the alert has expired
+	third := bytes.Replace(first, []byte("2018-03-29T11:34:13.537Z"), []byte("2018-03-29T11:34:33.537Z"), 1)
+
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "events.ndjson.gz")
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	for _, ev := range [][]byte{first, []byte("not json"), second, third} {
+		gz.Write(ev)
+		gz.Write([]byte("\n"))
+	}
+	gz.Close()
+	err = ioutil.WriteFile(file, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r replayer
+	r.init(AlertsMessage{Alerts: []AlertData{{Alert: a}, {Alert: otherDevice}}}, 1)
+	defer r.dd.cleanup()
+	err = r.replayFile(file)
+	if err != nil {
+		t.Fatal("replay error: ", err.Error())
+	}
+
+	report := r.report()
+	if report.Events != 4 || report.Unreadable != 1 {
+		t.Error("replay should count all events, got ", report.Events, " unreadable ", report.Unreadable)
+	}
+	if report.EventsMatched != 2 {
+		t.Error("events after the alert expired shouldn't match, got ", report.EventsMatched)
+	}
+	if len(report.Alerts) != 1 {
+		t.Fatal("only the matching alert should have hits, got ", len(report.Alerts))
+	}
+	if report.Alerts[0].Alert != a || report.Alerts[0].Hits != 2 {
+		t.Error("hits should be attributed to the alert for the device")
+	}
+	if len(report.Alerts[0].Events) != 1 || report.Alerts[0].Events[0] != "2c69a0c0-92a1-410c-870f-eb839bdee4fb" {
+		t.Error("matched event IDs should be limited")
+	}
+}
+
+func TestReplayOnlyWritesReport(t *testing.T) {
+	os.Setenv("AUDIT_LOG", "stdout")
+	os.Setenv("RETRO_WINDOW", "60")
+	defer os.Unsetenv("AUDIT_LOG")
+	defer os.Unsetenv("RETRO_WINDOW")
+
+	var r replayer
+	r.init(AlertsMessage{}, 1)
+	defer r.dd.cleanup()
+	if r.dd.audits.dest != "" || r.dd.retro.enabled() {
+		t.Error("audit log and retroactive matching should be off when replaying")
+	}
+}
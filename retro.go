@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	dt "github.com/trustnetworks/analytics-common/datatypes"
+	"github.com/trustnetworks/analytics-common/utils"
+	"github.com/trustnetworks/analytics-common/worker"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// an event kept in the look-back buffer, as it was sent to the output
+type retroEvent struct {
+	// processing time the event was seen, unix seconds
+	seen  int64
+	event []byte
+	keys  []string
+}
+
+// bounded buffer of recently seen events, re-evaluated when a new alert
+// loads so events seen just before the alert are tagged retroactively.
+// Events are indexed by the fields IOCs match on so only candidates are
+// re-evaluated. Retroactive hits are sent to a separate output, which needs
+// to be configured as one of the outputs e.g. retro:<queue>
+type retroBuffer struct {
+	// seconds events are kept for, zero disables the buffer
+	window    int64
+	maxEvents int
+	output    string
+
+	// held whilst changing the buffer
+	lock   sync.Mutex
+	events []*retroEvent
+	index  map[string]map[*retroEvent]bool
+
+	// retroactive hits waiting to be sent by the event handling goroutine
+	pending [][]byte
+
+	retroEventsCounter *worker.Counter
+}
+
+func (r *retroBuffer) init() {
+	window, err := strconv.ParseInt(utils.Getenv("RETRO_WINDOW", "0"), 10, 64)
+	if err != nil || window < 0 {
+		log.Error("Invalid RETRO_WINDOW, retroactive matching disabled")
+		window = 0
+	}
+	r.window = window
+	maxEvents, err := strconv.Atoi(utils.Getenv("RETRO_MAX_EVENTS", "10000"))
+	if err != nil || maxEvents < 0 {
+		log.Error("Invalid RETRO_MAX_EVENTS, using 10000")
+		maxEvents = 10000
+	}
+	r.maxEvents = maxEvents
+	r.output = utils.Getenv("RETRO_OUTPUT", "retro")
+	r.events = make([]*retroEvent, 0)
+	r.index = make(map[string]map[*retroEvent]bool)
+	r.pending = make([][]byte, 0)
+	r.retroEventsCounter = worker.CreateCounter(
+		worker.CounterOpts{
+			Name: "retroactive_events",
+			Help: "number of buffered events tagged when a new alert loaded",
+		}, []string{"analytic", "alert_type"},
+	)
+}
+
+func (r *retroBuffer) cleanup() {
+	worker.RemoveCounter(r.retroEventsCounter)
+}
+
+func (r *retroBuffer) enabled() bool {
+	return r.window > 0 && r.maxEvents > 0
+}
+
+// returns the index keys for the values IOCs match on. Hostnames are indexed
+// by every suffix as hostname patterns match subdomains
+func retroKeys(f eventFields) []string {
+	keys := make([]string, 0)
+	for patternType, values := range f {
+		for _, v := range values {
+			switch {
+			case patternType == "device":
+				keys = append(keys, "device:"+v)
+			case patternType == "hostname":
+				labels := strings.Split(strings.ToLower(v), ".")
+				for i := range labels {
+					keys = append(keys, "hostname:"+strings.Join(labels[i:], "."))
+				}
+			case strings.HasSuffix(patternType, ".ipv4") || strings.HasSuffix(patternType, ".ipv6"):
+				keys = append(keys, "ip:"+v)
+			}
+		}
+	}
+	return keys
+}
+
+// returns the index keys an alert's IOC could match events by
+func alertRetroKeys(a Alert) []string {
+	keys := make([]string, 0)
+	if a.Device != "" {
+		keys = append(keys, "device:"+a.Device)
+	}
+	switch a.Indicator.Type {
+	case "hostname":
+		keys = append(keys, "hostname:"+strings.ToLower(a.Indicator.Value))
+	case "ipv4", "ipv6":
+		keys = append(keys, "ip:"+a.Indicator.Value)
+	}
+	for _, ip := range []string{a.Src.IP, a.Dest.IP} {
+		if parts := strings.SplitN(ip, ":", 2); len(parts) == 2 {
+			keys = append(keys, "ip:"+parts[1])
+		}
+	}
+	return keys
+}
+
+// adds an event to the buffer
+func (r *retroBuffer) record(event []byte, now int64) {
+	if !r.enabled() {
+		return
+	}
+	f, err := extractEventFields(event)
+	if err != nil {
+		return
+	}
+	e := &retroEvent{seen: now, event: event, keys: retroKeys(f)}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.events = append(r.events, e)
+	for _, k := range e.keys {
+		if r.index[k] == nil {
+			r.index[k] = make(map[*retroEvent]bool)
+		}
+		r.index[k][e] = true
+	}
+	r.prune(now)
+}
+
+// drops events outside the window or over the size limit, the lock must be
+// held
+func (r *retroBuffer) prune(now int64) {
+	drop := 0
+	for drop < len(r.events) &&
+		(len(r.events)-drop > r.maxEvents || r.events[drop].seen < now-r.window) {
+		e := r.events[drop]
+		for _, k := range e.keys {
+			delete(r.index[k], e)
+			if len(r.index[k]) == 0 {
+				delete(r.index, k)
+			}
+		}
+		r.events[drop] = nil
+		drop++
+	}
+	if drop > 0 {
+		r.events = r.events[drop:]
+	}
+}
+
+// returns the buffered events an alert could match, using the most
+// selective index key. Alerts without an indexed field are not matched
+// retroactively, every buffered event would have to be decoded and looked up
+// with the state lock held
+func (r *retroBuffer) candidates(a Alert, now int64) []*retroEvent {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.prune(now)
+	var best map[*retroEvent]bool
+	indexed := false
+	for _, k := range alertRetroKeys(a) {
+		if !indexed || len(r.index[k]) < len(best) {
+			best = r.index[k]
+			indexed = true
+		}
+	}
+	if !indexed {
+		return nil
+	}
+	events := make([]*retroEvent, 0, len(best))
+	for _, e := range r.events {
+		if best[e] {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// re-evaluates the buffered events against a newly loaded alert, events that
+// now match it are queued for the retro output with its indicator added. In
+// event-time mode events before the alert became active do not match.
+// The state lock must be held
+func (dd *dynamicDetector) retroMatch(a Alert) {
+	if !dd.retro.enabled() {
+		return
+	}
+	now := dd.clock.Now().Unix()
+	for _, e := range dd.retro.candidates(a, now) {
+		var ev dt.Event
+		if json.Unmarshal(e.event, &ev) != nil {
+			continue
+		}
+		added := make([]*dt.Indicator, 0)
+		for _, matched := range dd.liveView().lookupAlerts(&ev, now) {
+			if matched != a {
+				continue
+			}
+			for _, i := range alertIndicators([]Alert{matched}) {
+				if !hasIndicator(&ev, i) {
+					added = append(added, i)
+				}
+			}
+		}
+		if len(added) == 0 {
+			continue
+		}
+		j, err := spliceIndicators(e.event, added)
+		if err != nil {
+			log.Error("couldn't add indicators to event JSON: ", err.Error())
+			continue
+		}
+		dd.retro.pending = append(dd.retro.pending, markRetroactive(j))
+		dd.retro.retroEventsCounter.Inc(worker.MetricLabels{"analytic": pgm, "alert_type": a.Type})
+	}
+}
+
+// returns true if the event was already tagged with the indicator
+func hasIndicator(ev *dt.Event, i *dt.Indicator) bool {
+	if ev.Indicators == nil {
+		return false
+	}
+	for _, existing := range *ev.Indicators {
+		if sameIndicator(existing, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// adds "retroactive": true to an event object so consumers can tell late
+// tags apart from tags added as the event passed through. An existing
+// retroactive field has its value replaced rather than being repeated
+func markRetroactive(event []byte) []byte {
+	start, end, found, err := topLevelField(event, "retroactive")
+	if err == nil && found {
+		marked := make([]byte, 0, len(event)-(end-start)+4)
+		marked = append(marked, event[:start]...)
+		marked = append(marked, "true"...)
+		return append(marked, event[end:]...)
+	}
+	opening := bytes.IndexByte(event, '{')
+	if opening < 0 {
+		return event
+	}
+	marked := make([]byte, 0, len(event)+20)
+	marked = append(marked, event[:opening+1]...)
+	marked = append(marked, `"retroactive":true`...)
+	rest := event[opening+1:]
+	if len(bytes.TrimSpace(rest)) > 1 {
+		marked = append(marked, ',')
+	}
+	return append(marked, rest...)
+}
+
+// sends the queued retroactive hits
+func (dd *dynamicDetector) sendRetroHits(w *worker.Worker) {
+	for _, j := range dd.retro.pending {
+		j := j
+		dd.send(w, dd.retro.output, &j)
+	}
+	dd.retro.pending = dd.retro.pending[:0]
+}
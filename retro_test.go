@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	dt "github.com/trustnetworks/analytics-common/datatypes"
+	"github.com/trustnetworks/analytics-common/worker"
+	"testing"
+	"time"
+)
+
+func TestRetroactiveMatchOnNewAlert(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	var dd dynamicDetector
+	dd.clock = clock
+	dd.Init()
+	dd.retro.window = 120
+
+	sent := make(map[string][][]byte)
+	Send = func(_ *worker.Worker, dest string, bs *[]byte) {
+		sent[dest] = append(sent[dest], *bs)
+	}
+
+	eventBytes := loadEventAsUint8sFromFile("test_data/single-dns-tunnel-event.json", t)
+	dd.Handle(*eventBytes, nil)
+
+	a := Alert{
+		Device: "theatregoing-mac",
+		Type:   "dns",
+		Indicator: dt.Indicator{
+			Type:        "hostname",
+			Value:       "blah.com",
+			Category:    "covert.dns-tunnel",
+			Probability: 0.9,
+			Id:          "b1769a6b-80c0-40e5-9287-a9a5d4262741",
+		},
+		TTL: 10,
+	}
+	otherDevice := a
+	otherDevice.Device = "another-dev"
+	dd.AddAlert(otherDevice)
+	if len(dd.retro.pending) != 0 {
+		t.Error("alert for another device should not match buffered events")
+	}
+
+	clock.Advance(30 * time.Second)
+	dd.AddAlert(a)
+	// re-raising an alert does not load a new IOC
+	dd.AddAlert(a)
+	if len(dd.retro.pending) != 1 {
+		t.Fatal("new alert should match the buffered event once, got ", len(dd.retro.pending))
+	}
+	dd.Handle(*eventBytes, nil)
+
+	if len(sent["output"]) != 2 || len(sent["retro"]) != 1 {
+		t.Fatal("retroactive hit should be sent to the retro output, got ", len(sent["retro"]))
+	}
+	var retro struct {
+		dt.Event
+		Retroactive bool `json:"retroactive"`
+	}
+	err := json.Unmarshal(sent["retro"][0], &retro)
+	if err != nil {
+		t.Fatal("JSON unmarshal error: ", err.Error())
+	}
+	if !retro.Retroactive {
+		t.Error("retroactive hit should be marked")
+	}
+	if retro.Indicators == nil || len(*retro.Indicators) != 1 || (*retro.Indicators)[0].Value != "blah.com" {
+		t.Error("retroactive hit should have the new alert's indicator")
+	}
+
+	// re-loading the alert only matches the first event again, the event
+	// seen whilst the alert was loaded was already tagged
+	dd.RevokeAlert(a, sourcePeer)
+	dd.AddAlert(a)
+	if len(dd.retro.pending) != 1 {
+		t.Error("events already tagged with the indicator should not be sent again, got ", len(dd.retro.pending))
+	}
+	dd.cleanup()
+}
+
+func TestRetroBufferLimits(t *testing.T) {
+	var r retroBuffer
+	r.init()
+	r.window = 120
+	r.maxEvents = 2
+	for i := 0; i < 5; i++ {
+		r.record([]byte(`{"device": "dev`+itoa(int64(i))+`"}`), 100)
+	}
+	if len(r.events) != 2 || len(r.index) != 2 {
+		t.Error("buffer should be limited to the maximum events, got ", len(r.events))
+	}
+	if len(r.candidates(Alert{Device: "dev4"}, 100)) != 1 || len(r.candidates(Alert{Device: "dev0"}, 100)) != 0 {
+		t.Error("dropped events should be removed from the index")
+	}
+	if len(r.candidates(Alert{Type: "useragent", Indicator: dt.Indicator{Type: "useragent", Value: "x"}}, 100)) != 0 {
+		t.Error("alerts without an indexed field should not be matched retroactively")
+	}
+	if len(r.candidates(Alert{Device: "dev4"}, 221)) != 0 || len(r.index) != 0 {
+		t.Error("events older than the window should be dropped")
+	}
+	r.cleanup()
+}
+
+func TestMarkRetroactive(t *testing.T) {
+	if string(markRetroactive([]byte(`{"id":"x"}`))) != `{"retroactive":true,"id":"x"}` {
+		t.Error("marker should be added to the start of the event")
+	}
+	if string(markRetroactive([]byte(`{}`))) != `{"retroactive":true}` {
+		t.Error("marker should be added to an empty event")
+	}
+	if string(markRetroactive([]byte(" \n{\"id\":\"x\"}"))) != " \n{\"retroactive\":true,\"id\":\"x\"}" {
+		t.Error("marker should be added after the opening brace of an event with leading whitespace")
+	}
+	if got := string(markRetroactive([]byte(`{"id":"x","retroactive": false,"n":1}`))); got != `{"id":"x","retroactive": true,"n":1}` {
+		t.Error("existing marker should be replaced not repeated, got ", got)
+	}
+	if got := string(markRetroactive([]byte(`{"retroactive":true,"id":"x"}`))); got != `{"retroactive":true,"id":"x"}` {
+		t.Error("event already marked should be unchanged, got ", got)
+	}
+	if got := string(markRetroactive([]byte(`{"meta":{"retroactive":false}}`))); got != `{"retroactive":true,"meta":{"retroactive":false}}` {
+		t.Error("only a top-level marker should be replaced, got ", got)
+	}
+}
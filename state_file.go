@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// saves the current alert state to a file, written to a temporary file first
+// so a crash part way through does not leave a corrupt state file
+func (dd *dynamicDetector) saveState(path string) error {
+	dd.lock.RLock()
+	am := AlertsMessage{Alerts: make([]AlertData, 0, len(dd.alerts))}
+	for k, v := range dd.alerts {
+		am.Alerts = append(am.Alerts, AlertData{Alert: k, Timeout: v, ValidFrom: dd.validFrom[k]})
+	}
+	dd.lock.RUnlock()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(tmp).Encode(am)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loads alert state saved by saveState. The timeouts were written by this
+// pod's clock so no clock skew correction is needed
+func loadStateFile(path string) (AlertsMessage, error) {
+	var am AlertsMessage
+	f, err := os.Open(path)
+	if err != nil {
+		return am, err
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(&am)
+	am.Now = 0
+	return am, err
+}
+
+// saves the alert state to the state file every interval, and once more when
+// the context is done
+func (dd *dynamicDetector) saveStatePeriodically(ctx context.Context) {
+	if dd.stateFile == "" {
+		return
+	}
+	ticker := dd.clock.NewTicker(dd.stateSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-ctx.Done():
+			if err := dd.saveState(dd.stateFile); err != nil {
+				log.Error("Couldn't save alert state to ", dd.stateFile, ": ", err.Error())
+			}
+			return
+		}
+		if err := dd.saveState(dd.stateFile); err != nil {
+			log.Error("Couldn't save alert state to ", dd.stateFile, ": ", err.Error())
+		}
+	}
+}
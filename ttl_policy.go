@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"github.com/trustnetworks/analytics-common/utils"
+	"github.com/trustnetworks/analytics-common/worker"
+)
+
+// TTL limits in seconds, a value of 0 means not set
+type ttlRule struct {
+	Min     int64 `json:"min,omitempty"`
+	Max     int64 `json:"max,omitempty"`
+	Default int64 `json:"default,omitempty"`
+}
+
+// TTL policy applied to alerts as they are ingested. Rules for a category
+// take precedence over rules for an alert type, which take precedence over
+// the default rule. e.g.
+//
+//	{"default": {"max": 86400},
+//	 "types": {"dns": {"min": 60, "default": 3600}},
+//	 "categories": {"covert.dns-tunnel": {"max": 7200}}}
+type ttlPolicy struct {
+	Default    ttlRule            `json:"default"`
+	Types      map[string]ttlRule `json:"types"`
+	Categories map[string]ttlRule `json:"categories"`
+
+	ttlAdjustedCounter *worker.Counter
+}
+
+func (p *ttlPolicy) init() {
+	policy := utils.Getenv("ALERT_TTL_POLICY", "")
+	if policy != "" {
+		err := json.Unmarshal([]byte(policy), p)
+		if err != nil {
+			log.Error("Couldn't parse ALERT_TTL_POLICY, alert TTLs will not be limited: ", err.Error())
+			*p = ttlPolicy{}
+		}
+	}
+
+	p.ttlAdjustedCounter = worker.CreateCounter(
+		worker.CounterOpts{
+			Name: "alert_ttls_adjusted",
+			Help: "number of alerts with a TTL changed or rejected by the TTL policy",
+		}, []string{"analytic", "alert_type", "action"},
+	)
+}
+
+func (p *ttlPolicy) cleanup() {
+	worker.RemoveCounter(p.ttlAdjustedCounter)
+}
+
+// works out the rule that applies to an alert, merging the default, type and
+// category rules
+func (p *ttlPolicy) ruleFor(a Alert) ttlRule {
+	rule := p.Default
+	for _, r := range []ttlRule{p.Types[a.Type], p.Categories[a.Indicator.Category]} {
+		if r.Min != 0 {
+			rule.Min = r.Min
+		}
+		if r.Max != 0 {
+			rule.Max = r.Max
+		}
+		if r.Default != 0 {
+			rule.Default = r.Default
+		}
+	}
+	return rule
+}
+
+// returns the alert with its effective TTL. Returns false if the alert has no
+// usable TTL and should be dropped. A missing TTL is defaulted before the
+// limits are applied, so a default outside them is clamped too
+func (p *ttlPolicy) apply(a Alert) (Alert, bool) {
+	rule := p.ruleFor(a)
+	requested := a.TTL
+	action := ""
+
+	if a.TTL <= 0 {
+		if rule.Default <= 0 {
+			log.Warn("dropping ", a.Type, " alert for ", a.Indicator.Value, " with TTL ", requested)
+			p.ttlAdjustedCounter.Inc(worker.MetricLabels{"analytic": pgm, "alert_type": a.Type, "action": "rejected"})
+			return a, false
+		}
+		a.TTL = rule.Default
+		action = "defaulted"
+	}
+	switch {
+	case rule.Min > 0 && a.TTL < rule.Min:
+		a.TTL = rule.Min
+		action = "clamped_min"
+	case rule.Max > 0 && a.TTL > rule.Max:
+		a.TTL = rule.Max
+		action = "clamped_max"
+	}
+
+	if action != "" {
+		log.Warn("TTL of ", a.Type, " alert for ", a.Indicator.Value, " changed from ",
+			requested, " to ", a.TTL, " (", action, ")")
+		p.ttlAdjustedCounter.Inc(worker.MetricLabels{"analytic": pgm, "alert_type": a.Type, "action": action})
+	}
+	return a, true
+}